@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/mkideal/cli"
+	"github.com/mlctrez/ifacemaker/maker"
+)
+
+// config is the content of the file given with --config. Each target holds
+// the flags of a run, keyed by their long names, e.g.
+//
+//	{
+//		"targets": [
+//			{
+//				"file": ["./store"],
+//				"struct": "Store",
+//				"iface": "IStore",
+//				"pkg": "iface",
+//				"output": "iface/store.go",
+//				"hooks": [["gofumpt", "-w", "{{.Output}}"]]
+//			}
+//		]
+//	}
+type config struct {
+	Targets []map[string]json.RawMessage `json:"targets"`
+}
+
+// configTarget is a target of the config file.
+type configTarget struct {
+	args cmdlineArgs
+	// hooks are the commands run after the outputs of the target are
+	// written, as templates of their arguments.
+	hooks [][]string
+}
+
+// globalFlags are the flags of the whole run, which cannot be set per target.
+var globalFlags = map[string]bool{
+	"help":         true,
+	"config":       true,
+	"print-config": true,
+	"stats":        true,
+	"events":       true,
+	"cpuprofile":   true,
+	"memprofile":   true,
+	"trace":        true,
+}
+
+// loadConfig reads the config file filename. Relative paths of the targets
+// are resolved against the directory of the file.
+func loadConfig(filename string) ([]configTarget, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", filename, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("invalid config %s: no targets", filename)
+	}
+	dir := filepath.Dir(filename)
+	var targets []configTarget
+	for i, values := range c.Targets {
+		t, err := parseConfigTarget(values, dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %s: target %d: %v", filename, i+1, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func parseConfigTarget(values map[string]json.RawMessage, dir string) (configTarget, error) {
+	var t configTarget
+	if raw, ok := values["hooks"]; ok {
+		if err := json.Unmarshal(raw, &t.hooks); err != nil {
+			return t, fmt.Errorf("hooks: %v", err)
+		}
+		for _, hook := range t.hooks {
+			if len(hook) == 0 {
+				return t, fmt.Errorf("hooks: empty command")
+			}
+		}
+		delete(values, "hooks")
+	}
+	if err := setDefaults(&t.args); err != nil {
+		return t, err
+	}
+	if err := setEnvDefaults(&t.args, nil); err != nil {
+		return t, err
+	}
+	if err := setFlags(&t.args, values); err != nil {
+		return t, err
+	}
+	for i, f := range t.args.Files {
+		t.args.Files[i] = resolvePath(dir, f)
+	}
+	if t.args.Output != "" {
+		t.args.Output = resolvePath(dir, t.args.Output)
+	}
+	if t.args.DocsFile != "" {
+		t.args.DocsFile = resolvePath(dir, t.args.DocsFile)
+	}
+	if t.args.Template != "" {
+		t.args.Template = resolvePath(dir, t.args.Template)
+	}
+	if t.args.Assertions != "" {
+		t.args.Assertions = resolvePath(dir, t.args.Assertions)
+	}
+	return t, nil
+}
+
+// envFlags are the flags defaulting to the environment variables set by go
+// generate, the file of the directive and its package.
+var envFlags = map[string]string{
+	"file": "GOFILE",
+	"pkg":  "GOPACKAGE",
+}
+
+// setEnvDefaults sets the flags of args not named by set to the values of the
+// environment variables of envFlags that are set.
+func setEnvDefaults(args *cmdlineArgs, set map[string]bool) error {
+	values := make(map[string]json.RawMessage)
+	for name, env := range envFlags {
+		value := os.Getenv(env)
+		if value == "" || set[name] {
+			continue
+		}
+		if name == "file" {
+			// The file is relative to the working directory, while the
+			// paths of a config file are relative to its directory.
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return err
+			}
+			value = abs
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[name] = b
+	}
+	return setFlags(args, values)
+}
+
+// resolveTargets returns the targets of the run of args: those of --config,
+// if given, or args alone. The flags are taken from, by increasing
+// precedence, their defaults, the environment variables of go generate, see
+// envFlags, the config file and the command line, whose flags are named by
+// set.
+func resolveTargets(args *cmdlineArgs, set map[string]bool) ([]configTarget, error) {
+	if args.Config == "" {
+		t := configTarget{args: *args}
+		if err := setEnvDefaults(&t.args, set); err != nil {
+			return nil, err
+		}
+		return []configTarget{t}, nil
+	}
+	targets, err := loadConfig(args.Config)
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		mergeFlags(&targets[i].args, args, set)
+	}
+	return targets, nil
+}
+
+// mergeFlags sets the flags of dst named by set, except the global flags, to
+// their values in src.
+func mergeFlags(dst, src *cmdlineArgs, set map[string]bool) {
+	values := make(map[string]reflect.Value)
+	flagFields(src, func(name string, field reflect.StructField, value reflect.Value) error {
+		values[name] = value
+		return nil
+	})
+	flagFields(dst, func(name string, field reflect.StructField, value reflect.Value) error {
+		if !set[name] || globalFlags[name] {
+			return nil
+		}
+		v := values[name]
+		if v.Kind() == reflect.Slice {
+			// The targets must not share the slice of src.
+			v = reflect.AppendSlice(reflect.MakeSlice(v.Type(), 0, v.Len()), v)
+		}
+		value.Set(v)
+		return nil
+	})
+}
+
+// commandLineFlags returns the long names of the flags of argv given on the
+// command line of ctx.
+func commandLineFlags(ctx *cli.Context, argv interface{}) map[string]bool {
+	set := make(map[string]bool)
+	flagFields(argv, func(name string, field reflect.StructField, value reflect.Value) error {
+		if ctx.IsSet("--" + name) {
+			set[name] = true
+		}
+		return nil
+	})
+	return set
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || isRemote(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// flagFields calls fn with every field of the struct pointed to by argv that
+// is a flag, with the long name of the flag.
+func flagFields(argv interface{}, fn func(name string, field reflect.StructField, value reflect.Value) error) error {
+	v := reflect.ValueOf(argv).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := field.Tag.Get("cli")
+		if tag == "" {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				if err := flagFields(v.Field(i).Addr().Interface(), fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for _, name := range strings.Split(strings.TrimLeft(tag, "*!"), ",") {
+			if len(name) > 1 {
+				if err := fn(name, field, v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setDefaults sets the flags of argv to the defaults of their dft tags.
+func setDefaults(argv interface{}) error {
+	return flagFields(argv, func(name string, field reflect.StructField, value reflect.Value) error {
+		dft, ok := field.Tag.Lookup("dft")
+		if !ok {
+			return nil
+		}
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(dft)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(dft)
+			if err != nil {
+				return err
+			}
+			value.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(dft, 10, 64)
+			if err != nil {
+				return err
+			}
+			value.SetInt(n)
+		default:
+			return fmt.Errorf("unsupported default of flag --%s", name)
+		}
+		return nil
+	})
+}
+
+// setFlags sets the flags of argv to the JSON values, keyed by the long
+// names of the flags. A single value is accepted for repeatable flags.
+func setFlags(argv interface{}, values map[string]json.RawMessage) error {
+	seen := make(map[string]bool)
+	err := flagFields(argv, func(name string, field reflect.StructField, value reflect.Value) error {
+		raw, ok := values[name]
+		if !ok {
+			return nil
+		}
+		if globalFlags[name] {
+			return fmt.Errorf("--%s applies to the whole run and cannot be set per target", name)
+		}
+		seen[name] = true
+		err := json.Unmarshal(raw, value.Addr().Interface())
+		if err != nil && value.Kind() == reflect.Slice {
+			elem := reflect.New(value.Type().Elem())
+			if json.Unmarshal(raw, elem.Interface()) == nil {
+				value.Set(reflect.Append(reflect.MakeSlice(value.Type(), 0, 1), elem.Elem()))
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name := range values {
+		if !seen[name] {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the targets to w as a config file, with every flag of
+// the targets including the defaults, so that it shows what is generated.
+func printConfig(w io.Writer, targets []configTarget) error {
+	var c struct {
+		Targets []map[string]interface{} `json:"targets"`
+	}
+	for i := range targets {
+		values := make(map[string]interface{})
+		err := flagFields(&targets[i].args, func(name string, field reflect.StructField, value reflect.Value) error {
+			if globalFlags[name] {
+				return nil
+			}
+			if value.Kind() == reflect.Slice && value.IsNil() {
+				// Print an empty list rather than null.
+				value = reflect.MakeSlice(value.Type(), 0, 0)
+			}
+			values[name] = value.Interface()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(targets[i].hooks) > 0 {
+			values["hooks"] = targets[i].hooks
+		}
+		c.Targets = append(c.Targets, values)
+	}
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	return e.Encode(c)
+}
+
+// runHooks runs the hooks of a target in dir after its output t was
+// written. The output of the commands is captured and only shown on failure.
+func runHooks(hooks [][]string, t maker.Target, dir string) error {
+	output, err := filepath.Abs(t.Output)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		var args []string
+		for _, arg := range hook {
+			tmpl, err := template.New("hook").Option("missingkey=error").Parse(arg)
+			if err != nil {
+				return fmt.Errorf("invalid hook argument %q: %v", arg, err)
+			}
+			var b bytes.Buffer
+			data := struct{ Struct, Interface, Output string }{t.StructName, t.IfaceName, output}
+			if err := tmpl.Execute(&b, data); err != nil {
+				return fmt.Errorf("invalid hook argument %q: %v", arg, err)
+			}
+			args = append(args, b.String())
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("hook %s of %s failed: %v\n%s", strings.Join(args, " "), t.Output, err, bytes.TrimSpace(out))
+		}
+		emit(event{Event: eventHookFinished, Message: strings.Join(args, " ")}, &t)
+	}
+	return nil
+}
+
+// configSchema returns the JSON Schema of the config file.
+func configSchema() (map[string]interface{}, error) {
+	properties := map[string]interface{}{
+		"hooks": map[string]interface{}{
+			"description": "Commands run after the outputs of the target are written. The arguments are templates of .Struct, .Interface and .Output.",
+			"type":        "array",
+			"items": map[string]interface{}{
+				"type":     "array",
+				"items":    map[string]interface{}{"type": "string"},
+				"minItems": 1,
+			},
+		},
+	}
+	err := flagFields(&cmdlineArgs{}, func(name string, field reflect.StructField, value reflect.Value) error {
+		if globalFlags[name] {
+			return nil
+		}
+		property := map[string]interface{}{"description": field.Tag.Get("usage")}
+		var typ string
+		switch value.Kind() {
+		case reflect.String:
+			typ = "string"
+		case reflect.Bool:
+			typ = "boolean"
+		case reflect.Int, reflect.Int64:
+			typ = "integer"
+		case reflect.Slice:
+			// A single value is accepted for repeatable flags.
+			property["type"] = []string{"string", "array"}
+			property["items"] = map[string]interface{}{"type": "string"}
+		default:
+			return fmt.Errorf("unsupported type of flag --%s", name)
+		}
+		if typ != "" {
+			property["type"] = typ
+		}
+		if dft, ok := field.Tag.Lookup("dft"); ok {
+			var v interface{} = dft
+			if typ != "string" {
+				if err := json.Unmarshal([]byte(dft), &v); err != nil {
+					return fmt.Errorf("invalid default of flag --%s: %v", name, err)
+				}
+			}
+			property["default"] = v
+		}
+		properties[name] = property
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "ifacemaker config",
+		"type":                 "object",
+		"required":             []string{"targets"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"targets": map[string]interface{}{
+				"type":     "array",
+				"minItems": 1,
+				// -f and -p may be set by go generate.
+				"items": map[string]interface{}{
+					"type":                 "object",
+					"required":             []string{"iface"},
+					"additionalProperties": false,
+					"properties":           properties,
+				},
+			},
+		},
+	}, nil
+}
+
+// validateConfig returns the problems of the config file filename that
+// would fail the generation before any source is parsed: unknown keys,
+// invalid flags, missing files and conflicting targets. The remote sources
+// are not fetched, and the structure names of -s - are not read from stdin,
+// so the targets of --all and --marked in remote sources and those read from
+// stdin are left to the generation.
+func validateConfig(filename string) []error {
+	configTargets, err := loadConfig(filename)
+	if err != nil {
+		return []error{err}
+	}
+	var problems []error
+	var all []maker.Target
+	for i := range configTargets {
+		args := &configTargets[i].args
+		fail := func(err error) {
+			problems = append(problems, fmt.Errorf("%s: target %d: %v", filename, i+1, err))
+		}
+		if err := checkArgs(args); err != nil {
+			fail(err)
+			continue
+		}
+		if args.DocsFile != "" {
+			if _, err := readDocsFile(args.DocsFile); err != nil {
+				fail(err)
+			}
+		}
+		if _, err := parseTemplate(args.Template); err != nil {
+			fail(err)
+		}
+		local, remote, err := checkSources(args.Files)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		m := newMaker(args, "")
+		if err := m.WalkGoFiles(local, func(string) error { return nil }); err != nil {
+			fail(err)
+			continue
+		}
+		var structs []string
+		for _, name := range args.StructType {
+			if name != "-" {
+				structs = append(structs, name)
+			}
+		}
+		switch discover := args.All || args.Marked || args.Marker != ""; {
+		case discover && remote:
+			// The structs may be declared in the sources not fetched.
+			continue
+		case !discover && len(structs) == 0 && len(args.StructType) > 0:
+			// The structs are all read from stdin.
+			continue
+		}
+		targets, err := structTargets(m, args, structs, local)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		for _, t := range targets {
+			if t.Output == "" {
+				continue
+			}
+			if info, err := os.Stat(filepath.Dir(t.Output)); err != nil || !info.IsDir() {
+				fail(fmt.Errorf("the directory of output %s does not exist", t.Output))
+			}
+		}
+		all = append(all, targets...)
+	}
+	if err := maker.CheckTargets(all); err != nil {
+		problems = append(problems, fmt.Errorf("%s: %v", filename, err))
+	}
+	return problems
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mkideal/cli"
+	"github.com/stretchr/testify/require"
+)
+
+// parseCommandLine parses the command line args like main, returning the
+// flags and the names of those given.
+func parseCommandLine(t *testing.T, args ...string) (*cmdlineArgs, map[string]bool) {
+	var argv *cmdlineArgs
+	var set map[string]bool
+	cmd := &cli.Command{
+		Argv: func() interface{} { return &cmdlineArgs{} },
+		Fn: func(ctx *cli.Context) error {
+			argv = ctx.Argv().(*cmdlineArgs)
+			set = commandLineFlags(ctx, argv)
+			return nil
+		},
+	}
+	require.Nil(t, cmd.Run(args))
+	return argv, set
+}
+
+func TestResolveTargets(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "c.json")
+	require.Nil(ioutil.WriteFile(filename, []byte(`{
+  "targets": [
+    {"file": "store", "struct": "Store", "iface": "IStore", "pkg": "iface", "output": "iface/store.go"},
+    {"file": "cache", "struct": "Cache", "iface": "ICache", "pkg": "iface", "no-result-names": false}
+  ]
+}`), 0644))
+
+	args, set := parseCommandLine(t, "--config", filename, "--force", "--no-result-names", "--stats")
+	require.Equal(map[string]bool{"config": true, "force": true, "no-result-names": true, "stats": true}, set)
+
+	targets, err := resolveTargets(args, set)
+	require.Nil(err)
+	require.Len(targets, 2)
+	for _, target := range targets {
+		require.True(target.args.Force)
+		require.True(target.args.NoResultNames)
+		// Global flags are not set per target.
+		require.False(target.args.Stats)
+		require.True(target.args.CopyDocs)
+	}
+	require.Equal([]string{filepath.Join(dir, "store")}, targets[0].args.Files)
+	require.Equal(filepath.Join(dir, "iface/store.go"), targets[0].args.Output)
+
+	var b bytes.Buffer
+	require.Nil(printConfig(&b, targets))
+	require.Contains(b.String(), `"no-result-names": true`)
+	require.NotContains(b.String(), `"no-result-names": false`)
+
+	// A flag given on the command line and in the config file is taken
+	// from the command line.
+	args, set = parseCommandLine(t, "--config", filename, "-f", "other.go")
+	targets, err = resolveTargets(args, set)
+	require.Nil(err)
+	require.Equal([]string{"other.go"}, targets[0].args.Files)
+	require.Equal([]string{"other.go"}, targets[1].args.Files)
+	targets[0].args.Files[0] = "changed.go"
+	require.Equal([]string{"other.go"}, targets[1].args.Files)
+
+	args, set = parseCommandLine(t, "-f", "a.go", "-s", "A", "-i", "IA", "-p", "p")
+	targets, err = resolveTargets(args, set)
+	require.Nil(err)
+	require.Len(targets, 1)
+	require.Equal(*args, targets[0].args)
+}
+
+func TestEnvDefaults(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	require.Nil(err)
+
+	t.Setenv("GOFILE", "store.go")
+	t.Setenv("GOPACKAGE", "store")
+
+	args, set := parseCommandLine(t, "-s", "Store", "-i", "IStore")
+	targets, err := resolveTargets(args, set)
+	require.Nil(err)
+	require.Equal([]string{filepath.Join(wd, "store.go")}, targets[0].args.Files)
+	require.Equal("store", targets[0].args.PkgName)
+
+	// The command line takes precedence over the environment.
+	args, set = parseCommandLine(t, "-f", "other.go", "-s", "Store", "-i", "IStore", "-p", "iface")
+	targets, err = resolveTargets(args, set)
+	require.Nil(err)
+	require.Equal([]string{"other.go"}, targets[0].args.Files)
+	require.Equal("iface", targets[0].args.PkgName)
+
+	// The config file takes precedence over the environment, and the
+	// command line over both.
+	filename := filepath.Join(dir, "c.json")
+	require.Nil(ioutil.WriteFile(filename, []byte(`{
+  "targets": [
+    {"struct": "Store", "iface": "IStore", "pkg": "iface"},
+    {"file": "cache.go", "struct": "Cache", "iface": "ICache"}
+  ]
+}`), 0644))
+	args, set = parseCommandLine(t, "--config", filename)
+	targets, err = resolveTargets(args, set)
+	require.Nil(err)
+	require.Equal([]string{filepath.Join(wd, "store.go")}, targets[0].args.Files)
+	require.Equal("iface", targets[0].args.PkgName)
+	require.Equal([]string{filepath.Join(dir, "cache.go")}, targets[1].args.Files)
+	require.Equal("store", targets[1].args.PkgName)
+
+	args, set = parseCommandLine(t, "--config", filename, "-p", "api")
+	targets, err = resolveTargets(args, set)
+	require.Nil(err)
+	require.Equal("api", targets[0].args.PkgName)
+	require.Equal("api", targets[1].args.PkgName)
+}
+
+func TestSetFlags(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []struct {
+		values   string
+		expected cmdlineArgs
+		err      string
+	}{
+		{`{}`, cmdlineArgs{}, ""},
+		{`{"struct": ["A", "B"], "iface": "I{{.Struct}}", "force": true, "workers": 2}`,
+			cmdlineArgs{StructType: []string{"A", "B"}, IfaceName: "I{{.Struct}}", Force: true, Workers: 2}, ""},
+		// A single value is accepted for repeatable flags.
+		{`{"file": "a.go", "tags": "integration"}`, cmdlineArgs{Files: []string{"a.go"}, Tags: []string{"integration"}}, ""},
+		{`{"force": "yes"}`, cmdlineArgs{}, "force: json: cannot unmarshal string into Go value of type bool"},
+		{`{"file": 1}`, cmdlineArgs{}, "file: json: cannot unmarshal number into Go value of type []string"},
+		{`{"stats": true}`, cmdlineArgs{}, "--stats applies to the whole run and cannot be set per target"},
+		{`{"frobnicate": true}`, cmdlineArgs{}, `unknown flag "frobnicate"`},
+	} {
+		var values map[string]json.RawMessage
+		require.Nil(json.Unmarshal([]byte(test.values), &values))
+		var args cmdlineArgs
+		err := setFlags(&args, values)
+		if test.err != "" {
+			require.EqualError(err, test.err, test.values)
+			continue
+		}
+		require.Nil(err, test.values)
+		require.Equal(test.expected, args, test.values)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "store.go"), []byte("package store\n\ntype Store struct{}\n\nfunc (s *Store) Get() {}\n"), 0644))
+
+	// Names read from stdin would conflict with the first target.
+	r, w, err := os.Pipe()
+	require.Nil(err)
+	defer r.Close()
+	_, err = w.WriteString("Store\n")
+	require.Nil(err)
+	require.Nil(w.Close())
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	filename := filepath.Join(dir, "c.json")
+	require.Nil(ioutil.WriteFile(filename, []byte(`{
+  "targets": [
+    {"file": "store.go", "struct": "Store", "iface": "IStore", "pkg": "iface", "output": "istore.go"},
+    {"file": "store.go", "struct": "-", "iface": "IStore", "pkg": "iface", "output": "istore.go"},
+    {"file": "example.invalid/repo@main//pkg", "all": true, "iface": "I{{.Struct}}", "pkg": "iface"},
+    {"file": "https://example.invalid/pkg/store.go", "struct": "Store", "iface": "IRemote", "pkg": "iface"}
+  ]
+}`), 0644))
+	require.Empty(validateConfig(filename))
+	b, err := ioutil.ReadAll(r)
+	require.Nil(err)
+	require.Equal("Store\n", string(b))
+
+	require.Nil(ioutil.WriteFile(filename, []byte(`{
+  "targets": [
+    {"file": "store.go", "struct": "Store", "iface": "IStore", "pkg": "iface", "output": "istore.go"},
+    {"file": "store.go", "all": true, "iface": "IStore", "pkg": "iface", "output": "istore.go"},
+    {"file": "example.invalid/repo@--upload-pack=touch//pkg", "struct": "Store", "iface": "IStore", "pkg": "iface"},
+    {"file": "https://example.invalid/pkg/store", "struct": "Store", "iface": "IStore", "pkg": "iface"},
+    {"file": "missing.go", "struct": "Store", "iface": "IStore", "pkg": "iface"}
+  ]
+}`), 0644))
+	var problems []string
+	for _, problem := range validateConfig(filename) {
+		problems = append(problems, problem.Error())
+	}
+	require.Equal([]string{
+		filename + `: target 3: fetching example.invalid/repo@--upload-pack=touch//pkg: invalid ref "--upload-pack=touch": use a branch, tag or commit`,
+		filename + `: target 4: fetching https://example.invalid/pkg/store: not a Go source file, the URL must end with .go`,
+		filename + `: target 5: stat ` + filepath.Join(dir, "missing.go") + `: no such file or directory`,
+	}, problems[:3])
+	require.Len(problems, 4)
+	require.Contains(problems[3], filename+": conflicting targets:")
+	require.Contains(problems[3], "output "+filepath.Join(dir, "istore.go")+" is written for Store, Store")
+}
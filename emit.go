@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/mlctrez/ifacemaker/maker"
+)
+
+const (
+	formatGo       = "go"
+	formatJSON     = "json"
+	formatMarkdown = "markdown"
+	formatTemplate = "template"
+)
+
+// formatExtensions are the extensions of the default output paths of the
+// formats other than go and template, whose path is required.
+var formatExtensions = map[string]string{
+	formatJSON:     ".json",
+	formatMarkdown: ".md",
+}
+
+// emitFormat is a format of --emit, with the template of its output path.
+type emitFormat struct {
+	format, path string
+}
+
+// parseEmit parses the values of --emit, comma separated formats with an
+// optional output path, e.g. go,json=api/{{.Struct}}.json,markdown. The
+// default is go alone.
+func parseEmit(values []string) ([]emitFormat, error) {
+	var formats []emitFormat
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, f := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(f), "=", 2)
+			ef := emitFormat{format: parts[0]}
+			if len(parts) == 2 {
+				ef.path = parts[1]
+			}
+			switch {
+			case ef.format != formatGo && ef.format != formatTemplate && formatExtensions[ef.format] == "":
+				return nil, fmt.Errorf("unknown --emit format %q, use go, json, markdown or template", ef.format)
+			case ef.format == formatGo && ef.path != "":
+				return nil, fmt.Errorf("the path of the go output is set with --output")
+			case ef.format == formatTemplate && ef.path == "":
+				return nil, fmt.Errorf("--emit template requires a path, e.g. template={{.Struct}}_mock.go")
+			case seen[ef.format]:
+				return nil, fmt.Errorf("--emit lists %s more than once", ef.format)
+			}
+			seen[ef.format] = true
+			formats = append(formats, ef)
+		}
+	}
+	if len(formats) == 0 {
+		formats = []emitFormat{{format: formatGo}}
+	}
+	return formats, nil
+}
+
+// emitsGo reports whether the go format is one of formats.
+func emitsGo(formats []emitFormat) bool {
+	for _, f := range formats {
+		if f.format == formatGo {
+			return true
+		}
+	}
+	return false
+}
+
+// emitPath returns the output path of the format f for the target t, by
+// default that of the go output with the extension of the format.
+func emitPath(f emitFormat, t maker.Target) (string, error) {
+	if f.path == "" {
+		return strings.TrimSuffix(t.Output, ".go") + formatExtensions[f.format], nil
+	}
+	tmpl, err := template.New("emit").Option("missingkey=error").Parse(f.path)
+	if err != nil {
+		return "", fmt.Errorf("invalid --emit path template: %v", err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, struct{ Struct string }{t.StructName}); err != nil {
+		return "", fmt.Errorf("invalid --emit path template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// checkEmitted refuses to overwrite the existing outputs of the formats for
+// the target t that do not look generated, unless force is true, like the go
+// output.
+func checkEmitted(formats []emitFormat, t maker.Target, force bool) error {
+	for _, f := range formats {
+		if f.format == formatGo {
+			continue
+		}
+		filename, err := emitPath(f, t)
+		if err != nil {
+			return err
+		}
+		if err := checkOverwrite(filename, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// generatedText marks the json and markdown outputs as generated, like
+	// the comment of the go output.
+	generatedText     = "Code generated by ifacemaker. DO NOT EDIT."
+	generatedMarkdown = "<!-- " + generatedText + " -->"
+)
+
+// generatedJSON is the model written for the json format, with a field
+// marking it generated.
+type generatedJSON struct {
+	Generated string `json:"generated"`
+	maker.Model
+}
+
+// isGeneratedDoc reports whether b is a json or markdown output of ifacemaker.
+func isGeneratedDoc(b []byte) bool {
+	if bytes.HasPrefix(b, []byte(generatedMarkdown)) {
+		return true
+	}
+	var model generatedJSON
+	return json.Unmarshal(b, &model) == nil && model.Generated == generatedText
+}
+
+// writeEmitted writes the outputs of the formats other than go for the
+// target t generated by m, with tmpl, the template of --template, for the
+// template format.
+func writeEmitted(m *maker.Maker, formats []emitFormat, pkgName string, tmpl *template.Template, t maker.Target) error {
+	for _, f := range formats {
+		if f.format == formatGo {
+			continue
+		}
+		filename, err := emitPath(f, t)
+		if err != nil {
+			return err
+		}
+		model := m.Model(pkgName, t.IfaceName)
+		var b []byte
+		switch f.format {
+		case formatJSON:
+			if b, err = json.MarshalIndent(generatedJSON{generatedText, model}, "", "  "); err != nil {
+				return err
+			}
+			b = append(b, '\n')
+		case formatMarkdown:
+			b = markdown(model)
+		case formatTemplate:
+			if b, err = executeTemplate(tmpl, model); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return err
+		}
+		emit(event{Event: eventFileWritten, File: filename}, &t)
+	}
+	return nil
+}
+
+// markdown returns the documentation page of the interface of model.
+func markdown(model maker.Model) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n\n# %s\n\n", generatedMarkdown, model.Interface)
+	fmt.Fprintf(&b, "Interface `%s%s` of package `%s`, generated from `%s`.\n",
+		model.Interface, model.TypeParams, model.Package, model.Struct)
+	if model.Doc != "" {
+		fmt.Fprintf(&b, "\n%s\n", model.Doc)
+	}
+	if len(model.Embeds) > 0 {
+		b.WriteString("\n## Embedded Interfaces\n\n")
+		for _, e := range model.Embeds {
+			fmt.Fprintf(&b, "- `%s`\n", e)
+		}
+	}
+	if len(model.Methods) > 0 {
+		b.WriteString("\n## Methods\n")
+	}
+	for _, method := range model.Methods {
+		fmt.Fprintf(&b, "\n### %s\n\n```go\n%s\n```\n", method.Name, method.Signature)
+		if method.Embedded != "" {
+			fmt.Fprintf(&b, "\nDeclared by the embedded `%s`.\n", method.Embedded)
+		}
+		if method.Doc != "" {
+			fmt.Fprintf(&b, "\n%s\n", method.Doc)
+		}
+	}
+	return b.Bytes()
+}
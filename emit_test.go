@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mlctrez/ifacemaker/maker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitOverwrite(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	m := &maker.Maker{StructName: "Store"}
+	require.Nil(m.ParseSource([]byte(`package store
+
+type Store struct{}
+
+// Get returns the value of key.
+func (s *Store) Get(key string) string { return "" }
+`), "store.go"))
+	_, err = m.MakeInterface("store", "IStore")
+	require.Nil(err)
+
+	readme := filepath.Join(dir, "README.md")
+	handWritten := []byte("# Store\n\nHand-written.\n")
+	require.Nil(ioutil.WriteFile(readme, handWritten, 0644))
+
+	target := maker.Target{StructName: "Store", IfaceName: "IStore", Output: filepath.Join(dir, "istore.go")}
+	formats, err := parseEmit([]string{"go,json", "markdown=" + readme})
+	require.Nil(err)
+
+	err = checkEmitted(formats, target, false)
+	require.EqualError(err, "refusing to overwrite "+readme+": it does not look generated, use --force to overwrite it anyway")
+	b, err := ioutil.ReadFile(readme)
+	require.Nil(err)
+	require.Equal(handWritten, b)
+	require.Nil(checkEmitted(formats, target, true))
+
+	// The outputs of a previous run are overwritten.
+	formats, err = parseEmit([]string{"json,markdown"})
+	require.Nil(err)
+	require.Nil(writeEmitted(m, formats, "store", nil, target))
+	require.Nil(checkEmitted(formats, target, false))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "istore.json"))
+	require.Nil(err)
+	require.Contains(string(b), `"generated": "Code generated by ifacemaker. DO NOT EDIT."`)
+	require.Contains(string(b), `"signature": "Get(key string) string"`)
+}
+
+func TestParseEmit(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []struct {
+		values  []string
+		formats []emitFormat
+		err     string
+	}{
+		{nil, []emitFormat{{format: "go"}}, ""},
+		{[]string{"go,json"}, []emitFormat{{format: "go"}, {format: "json"}}, ""},
+		{[]string{"markdown=docs/{{.Struct}}.md", " json"}, []emitFormat{{"markdown", "docs/{{.Struct}}.md"}, {format: "json"}}, ""},
+		{[]string{"xml"}, nil, `unknown --emit format "xml", use go, json, markdown or template`},
+		{[]string{"template=mocks/{{.Struct}}.go"}, []emitFormat{{"template", "mocks/{{.Struct}}.go"}}, ""},
+		{[]string{"template"}, nil, "--emit template requires a path, e.g. template={{.Struct}}_mock.go"},
+		{[]string{"go=x.go"}, nil, "the path of the go output is set with --output"},
+		{[]string{"json", "go,json"}, nil, "--emit lists json more than once"},
+	} {
+		formats, err := parseEmit(test.values)
+		if test.err != "" {
+			require.EqualError(err, test.err, "%v", test.values)
+			continue
+		}
+		require.Nil(err, "%v", test.values)
+		require.Equal(test.formats, formats, "%v", test.values)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mlctrez/ifacemaker/maker"
+)
+
+// event is a step of the run reported by --events ndjson.
+type event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Struct, Interface and Output identify the target of the event.
+	Struct    string `json:"struct,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Output    string `json:"output,omitempty"`
+	// File is the parsed or written file.
+	File    string `json:"file,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+	// ElapsedMS is the duration of the step in milliseconds.
+	ElapsedMS float64 `json:"elapsed_ms,omitempty"`
+	// SHA256 is the checksum of the generated code.
+	SHA256   string `json:"sha256,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+const (
+	eventTargetStarted   = "target_started"
+	eventFileParsed      = "file_parsed"
+	eventTargetGenerated = "target_generated"
+	eventFileWritten     = "file_written"
+	eventHookFinished    = "hook_finished"
+	eventDiagnostic      = "diagnostic"
+)
+
+// events encodes the events to stdout, nil unless --events ndjson is given.
+var events *json.Encoder
+
+// startEvents enables the events of the format, which must be empty or
+// ndjson.
+func startEvents(format string) error {
+	switch format {
+	case "":
+	case "ndjson":
+		events = json.NewEncoder(os.Stdout)
+	default:
+		return fmt.Errorf("unknown events format %q, use ndjson", format)
+	}
+	return nil
+}
+
+// emit writes e if events are enabled. A target t, if not nil, identifies
+// the target of the event.
+func emit(e event, t *maker.Target) {
+	if events == nil {
+		return
+	}
+	e.Time = time.Now()
+	if t != nil {
+		e.Struct, e.Interface, e.Output = t.StructName, t.IfaceName, t.Output
+	}
+	// Events are best effort, failing to write them does not fail the run.
+	_ = events.Encode(e)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -8,6 +8,7 @@ require (
 	github.com/mkideal/cli v0.0.2
 	github.com/mkideal/pkg v0.0.0-20170503154153-3e188c9e7ecc // indirect
 	github.com/pkg/errors v0.8.0
+	go.yaml.in/yaml/v3 v3.0.5
 	golang.org/x/sys v0.0.0-20181026203630-95b1ffbd15a5 // indirect
 	golang.org/x/tools v0.0.0-20181026183834-f60e5f99f081
 )
@@ -1,65 +1,1084 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"go/parser"
+	"go/token"
+	"go/version"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/mkideal/cli"
 	"github.com/mlctrez/ifacemaker/maker"
+	"go.yaml.in/yaml/v3"
 )
 
 type cmdlineArgs struct {
 	cli.Helper
-	Files      []string `cli:"*f,file"      usage:"Go source file or directory to read"`
-	StructType string   `cli:"*s,struct"    usage:"Generate an interface for this structure name"`
-	IfaceName  string   `cli:"*i,iface"     usage:"Name of the generated interface"`
-	PkgName    string   `cli:"*p,pkg"       usage:"Package name for the generated interface"`
-	CopyDocs   bool     `cli:"d,doc"        usage:"Copy method documentation from source files." dft:"true"`
-	Output     string   `cli:"o,output"     usage:"Output file name. If not provided, result will be printed to stdout."`
-	AddImport  string   `cli:"a,add-import" usage:"An additional import to add to the generated file."`
-	Rewrite    string   `cli:"r,rewrite"    usage:"Rewrites unqualified exports with this package prefix."`
+	Files           []string `cli:"f,file"            usage:"Go source file or directory to read, or a URL of a file or repo@ref//path to fetch. Required without --config, defaults to $GOFILE under go generate."`
+	StructType      []string `cli:"s,struct"          usage:"Generate an interface for this structure name, or for those read from stdin, one per line, for -. Can be repeated."`
+	All             bool     `cli:"all"               usage:"Generate an interface for every exported type with methods."`
+	Marked          bool     `cli:"marked"            usage:"Generate an interface for every type annotated with //ifacemaker:generate or embedding the --marker type."`
+	Marker          string   `cli:"marker"            usage:"Type whose embedding selects the types for --marked, as written in the sources, e.g. ifacegen.Marker."`
+	IfaceName       string   `cli:"i,iface"           usage:"Name of the generated interface, a template like I{{.Struct}} when generating several. Required without --config."`
+	PkgName         string   `cli:"p,pkg"             usage:"Package name for the generated interface. Required without --config, defaults to $GOPACKAGE under go generate."`
+	CopyDocs        bool     `cli:"d,doc"             usage:"Copy method documentation from source files." dft:"true"`
+	DocsFile        string   `cli:"docs-file"         usage:"JSON or YAML file mapping method names, or Type.Method, to doc comments for the methods without one."`
+	CopyTypeDoc     bool     `cli:"D,type-doc"        usage:"Copy the documentation of the struct to the interface."`
+	IfaceComment    string   `cli:"y,iface-comment"   usage:"Comment for the interface, before the documentation of the struct."`
+	Record          bool     `cli:"record"            usage:"Record the arguments of the run in the generated files, to generate them again with ifacemaker regen."`
+	Comment         string   `cli:"c,comment"         usage:"Comment to add to the top of the generated file."`
+	Output          string   `cli:"o,output"          usage:"Output file name, a template like {{.Struct}}_iface.go when generating several. If not provided, result will be printed to stdout."`
+	Emit            []string `cli:"emit"              usage:"Formats to write, comma separated: go, json for the model of the interface, markdown for its documentation page or template for the output of --template. Formats but go take a path template like json={{.Struct}}.json, by default the output with the extension of the format, required for template. Defaults to go."`
+	Template        string   `cli:"template"          usage:"File of a Go text/template executed with the model of each interface for --emit template, see the README for its helpers."`
+	AddImport       string   `cli:"a,add-import"      usage:"An additional import to add to the generated file."`
+	Rewrite         string   `cli:"r,rewrite"         usage:"Rewrites unqualified exports with this package prefix."`
+	Assert          string   `cli:"assert"            usage:"Import path of the source package, to assert that the struct implements the interface without --rewrite."`
+	Assertions      string   `cli:"assertions"        usage:"Write the assertions of --assert of all the targets to this file, e.g. zz_assertions_gen.go or assertions_test.go, instead of the outputs."`
+	AssertionsPkg   string   `cli:"assertions-pkg"    usage:"Package name of the --assertions file. Defaults to -p."`
+	IfaceImport     string   `cli:"iface-import"      usage:"Import path of the package of the interfaces, required by an --assertions file of another package than -p."`
+	Duplicates      string   `cli:"duplicates"        usage:"Policy for methods declared in several files: first, error, build or identical." dft:"first"`
+	Tags            []string `cli:"tags"              usage:"Build tags of the target build configuration used by --duplicates=build."`
+	CopyBuild       bool     `cli:"copy-build"        usage:"Copy the //go:build line shared by the source files declaring the methods to the output." dft:"true"`
+	Variants        []string `cli:"variants"          usage:"Generate an output file per build configuration, e.g. linux or windows/amd64, from the files it includes. Can be repeated."`
+	Promote         bool     `cli:"promote"           usage:"Include methods promoted from embedded fields declared in the source files."`
+	MirrorEmbedding bool     `cli:"mirror-embedding"  usage:"Embed the interfaces generated in the same run for embedded fields instead of listing their methods. Implies --promote."`
+	ContinueOnError bool     `cli:"continue-on-error" usage:"Skip source files that cannot be parsed instead of failing."`
+	ParamComments   bool     `cli:"param-comments"    usage:"Copy comments inside parameter lists to the generated methods."`
+	LineEndings     string   `cli:"line-endings"      usage:"Line endings of the output: lf, crlf or auto to keep those of the existing output file or the source files." dft:"lf"`
+	MaxFileSize     int64    `cli:"max-file-size"     usage:"Warn about files in directories larger than this many bytes, 0 for no limit." dft:"1048576"`
+	SkipLargeFiles  bool     `cli:"skip-large-files"  usage:"Skip files in directories larger than --max-file-size."`
+	MaxFiles        int      `cli:"max-files"         usage:"Fail if more than this many files are found, 0 for no limit."`
+	Force           bool     `cli:"force"             usage:"Overwrite the output file even if it does not look generated."`
+	Vet             bool     `cli:"vet"               usage:"Type check the generated code before writing it."`
+	Unimplemented   string   `cli:"unimplemented"     usage:"Add an Unimplemented struct for embedding, whose methods return an error or panic: error or panic."`
+	Examples        bool     `cli:"examples"          usage:"Write a skeleton Example function per method to the test file next to the output, e.g. x_iface_example_test.go, unless it exists."`
+	Multiplexer     bool     `cli:"multiplexer"       usage:"Add a slice type forwarding the calls to all of its implementations."`
+	Decorators      []string `cli:"decorator"         usage:"Add a wrapper of the interface: cache or locked. Can be repeated."`
+	CacheMethods    string   `cli:"cache-methods"     usage:"Regular expression selecting the methods cached by --decorator=cache, besides those annotated with //ifacemaker:cache."`
+	ReadOnlyMethods string   `cli:"readonly-methods"  usage:"Regular expression selecting the methods --decorator=locked runs under a read lock, besides those annotated with //ifacemaker:readonly."`
+	Workers         int      `cli:"workers"           usage:"Number of source files parsed concurrently, 0 for the number of CPUs."`
+	NoResultNames   bool     `cli:"no-result-names"   usage:"Drop the names of the results of the methods."`
+	ExcludeMethods  string   `cli:"exclude-methods"   usage:"Regular expression selecting the methods left out of the interface by name."`
+	CPUProfile      string   `cli:"cpuprofile"        usage:"Write a CPU profile of the run to this file."`
+	MemProfile      string   `cli:"memprofile"        usage:"Write a memory profile at the end of the run to this file."`
+	Trace           string   `cli:"trace"             usage:"Write an execution trace of the run to this file."`
+	Lang            string   `cli:"lang"              usage:"Go language version of the sources, e.g. go1.21. Defaults to the go directive of the module."`
+	GoVersion       string   `cli:"go-version"        usage:"Go version the generated code must build with, if older than --lang, e.g. go1.17 to replace any with interface{}."`
+	Events          string   `cli:"events"            usage:"Write an event per step of the run to stdout, for build systems: ndjson."`
+	Config          string   `cli:"config"            usage:"Generate the targets of this JSON file, each with its own flags and hooks run after writing its output."`
+	Stats           bool     `cli:"stats"             usage:"Print a summary of the files and methods of each interface to stderr at the end of the run."`
+	PrintConfig     bool     `cli:"print-config"      usage:"Print the targets with all of their flags, merged from the defaults, --config and the command line, as a config file instead of generating them."`
 }
 
-func Run(args *cmdlineArgs) {
-	maker := &maker.Maker{
-		StructName: args.StructType,
-		CopyDocs:   args.CopyDocs,
+func Run(args *cmdlineArgs, set map[string]bool) {
+	if err := startEvents(args.Events); err != nil {
+		exit(err)
+	}
+	configTargets, err := resolveTargets(args, set)
+	if err != nil {
+		exit(err)
+	}
+	dir := "."
+	if args.Config != "" {
+		dir = filepath.Dir(args.Config)
+	}
+	if args.PrintConfig {
+		if err := printConfig(os.Stdout, configTargets); err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	type output struct {
+		target maker.Target
+		code   []byte
+		args   *cmdlineArgs
+		maker  *maker.Maker
+		hooks  [][]string
+		// formats are those of --emit, and tmpl the template of
+		// --template.
+		formats []emitFormat
+		tmpl    *template.Template
+	}
+	var outputs []output
+	var all []maker.Target
+	var makers []*maker.Maker
+	for i := range configTargets {
+		ct := &configTargets[i]
+		targets, results, m := generateAll(&ct.args, nil)
+		formats, err := parseEmit(ct.args.Emit)
+		if err != nil {
+			exit(err)
+		}
+		tmpl, err := parseTemplate(ct.args.Template)
+		if err != nil {
+			exit(err)
+		}
+		for j, t := range targets {
+			outputs = append(outputs, output{target: t, code: results[j], args: &ct.args, maker: m[j], hooks: ct.hooks, formats: formats, tmpl: tmpl})
+		}
+		all = append(all, targets...)
+		makers = append(makers, m...)
+	}
+	if len(configTargets) > 1 {
+		if err := maker.CheckTargets(all); err != nil {
+			exit(err)
+		}
+	}
+
+	var assertions []*assertionFile
+	for _, o := range outputs {
+		if o.args.Assertions == "" {
+			continue
+		}
+		if err := addAssertion(&assertions, o.maker, o.args, o.target); err != nil {
+			fail(err, &o.target)
+		}
+	}
+	for _, f := range assertions {
+		if err := checkOverwrite(f.filename, f.force); err != nil {
+			exit(err)
+		}
+	}
+	for _, o := range outputs {
+		if o.target.Output != "" && emitsGo(o.formats) {
+			if err := checkOverwrite(o.target.Output, o.args.Force); err != nil {
+				fail(err, &o.target)
+			}
+		}
+		if err := checkEmitted(o.formats, o.target, o.args.Force); err != nil {
+			fail(err, &o.target)
+		}
+	}
+	for _, o := range outputs {
+		t := o.target
+		if err := writeEmitted(o.maker, o.formats, o.args.PkgName, o.tmpl, t); err != nil {
+			fail(err, &t)
+		}
+		if emitsGo(o.formats) {
+			if t.Output == "" {
+				fmt.Println(string(o.code))
+				continue
+			}
+			if err := ioutil.WriteFile(t.Output, o.code, 0644); err != nil {
+				fail(err, &t)
+			}
+			emit(event{Event: eventFileWritten, File: t.Output}, &t)
+		}
+		if t.Output == "" {
+			continue
+		}
+		if o.args.Examples {
+			if err := writeExamples(o.maker, o.args.PkgName, t); err != nil {
+				fail(err, &t)
+			}
+		}
+		if err := runHooks(o.hooks, t, dir); err != nil {
+			fail(err, &t)
+		}
+	}
+	for _, f := range assertions {
+		code, err := maker.MakeAssertions(f.pkgName, f.assertions)
+		if err != nil {
+			exit(err)
+		}
+		if err := ioutil.WriteFile(f.filename, code, 0644); err != nil {
+			exit(err)
+		}
+		emit(event{Event: eventFileWritten, File: f.filename}, nil)
+	}
+	if args.Stats {
+		printStats(os.Stderr, all, makers)
+	}
+}
+
+// assertionFile is an --assertions file, with the assertions of the targets
+// writing to it.
+type assertionFile struct {
+	filename, pkgName string
+	force             bool
+	assertions        []maker.Assertion
+}
+
+// addAssertion adds the assertion of the target t generated by m to its
+// --assertions file in files.
+func addAssertion(files *[]*assertionFile, m *maker.Maker, args *cmdlineArgs, t maker.Target) error {
+	a, err := m.Assertion(t.IfaceName)
+	if err != nil {
+		return err
+	}
+	if args.IfaceImport != "" {
+		a.IfaceImport, a.IfacePackage = args.IfaceImport, args.PkgName
+	}
+	pkgName := args.AssertionsPkg
+	if pkgName == "" {
+		pkgName = args.PkgName
+	}
+	filename := filepath.Clean(args.Assertions)
+	for _, f := range *files {
+		if f.filename != filename {
+			continue
+		}
+		if f.pkgName != pkgName {
+			return fmt.Errorf("the assertions of %s cannot be in both packages %s and %s", filename, f.pkgName, pkgName)
+		}
+		f.assertions = append(f.assertions, a)
+		return nil
+	}
+	*files = append(*files, &assertionFile{filename: filename, pkgName: pkgName, force: args.Force, assertions: []maker.Assertion{a}})
+	return nil
+}
+
+// writeExamples writes the examples of --examples for the target t generated
+// by m, unless the file exists, as it is meant to be edited.
+func writeExamples(m *maker.Maker, pkgName string, t maker.Target) error {
+	filename := strings.TrimSuffix(t.Output, ".go") + "_example_test.go"
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+	b, err := m.MakeExamples(pkgName, t.IfaceName)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return err
+	}
+	emit(event{Event: eventFileWritten, File: filename}, &t)
+	return nil
+}
+
+// printStats writes the summary of --stats of the targets generated by
+// makers to w.
+func printStats(w io.Writer, targets []maker.Target, makers []*maker.Maker) {
+	for i, t := range targets {
+		s := makers[i].Stats()
+		name := t.IfaceName
+		if t.GOOS != "" {
+			name += " (" + strings.TrimSuffix(t.GOOS+"/"+t.GOARCH, "/") + ")"
+		}
+		fmt.Fprintf(w, "%s from %s: %d files scanned, %d parsed, %d skipped as unrelated, %d excluded by the build, %d failed to parse\n",
+			name, t.StructName, s.FilesScanned(), s.FilesParsed, s.FilesSkipped, s.FilesExcluded, s.FilesFailed)
+		// Every reason is listed, so that those that do not apply are not
+		// looked for.
+		var skipped []string
+		total := 0
+		for _, reason := range maker.SkipReasons {
+			n := s.SkippedMethods[reason]
+			skipped = append(skipped, fmt.Sprintf("%d %s", n, reason))
+			total += n
+		}
+		fmt.Fprintf(w, "\t%d methods included, %d skipped: %s\n", s.Methods, total, strings.Join(skipped, ", "))
+	}
+}
+
+// generateAll generates the interfaces of all targets of args and returns
+// them with the makers that generated them, exiting on errors. configure,
+// if not nil, is applied to each of the makers before parsing.
+func generateAll(args *cmdlineArgs, configure func(*maker.Maker)) ([]maker.Target, [][]byte, []*maker.Maker) {
+	if err := checkArgs(args); err != nil {
+		exit(err)
+	}
+	methodDocs, err := readDocsFile(args.DocsFile)
+	if err != nil {
+		exit(err)
+	}
+	files, err := fetchSources(args.Files)
+	defer removeTempDirs()
+	if err != nil {
+		exit(err)
+	}
+	m := newMaker(args, "")
+
+	// Warnings are printed even if the generation fails later, as they often
+	// explain the failure, e.g. a skipped file.
+	var current *maker.Target
+	printWarnings := func(m *maker.Maker) {
+		for _, w := range m.Warnings() {
+			log.Printf("warning: %s", w)
+			emit(event{Event: eventDiagnostic, Severity: "warning", Message: w}, current)
+		}
+	}
+	fatal := func(err error) {
+		printWarnings(m)
+		fail(err, current)
+	}
+
+	goVersion := args.Lang
+	if goVersion == "" {
+		goVersion, err = maker.ModuleGoVersion(sourceDir(files[0]))
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if goVersion != "" && !version.IsValid(goVersion) {
+		fatal(fmt.Errorf("invalid Go version %q, use e.g. go1.21", goVersion))
+	}
+
+	targets, err := findTargets(m, args, files)
+	if err != nil {
+		fatal(err)
+	}
+	// Check all targets before generating anything, so that a conflict does
+	// not leave some of the outputs written.
+	if err := maker.CheckTargets(targets); err != nil {
+		fatal(err)
+	}
+	for _, t := range targets {
+		if events != nil && t.Output == "" {
+			fatal(fmt.Errorf("--events writes the events to stdout, use -o to write the code to files"))
+		}
+	}
+	printWarnings(m)
+
+	// The interfaces of the run are those embedded by --mirror-embedding.
+	ifaces := make(map[string]string)
+	for _, t := range targets {
+		ifaces[t.StructName] = t.IfaceName
+	}
+
+	results := make([][]byte, len(targets))
+	makers := make([]*maker.Maker, len(targets))
+	// The targets read the same files, which are parsed once for all of
+	// them.
+	var cache *maker.ParseCache
+	if len(targets) > 1 {
+		cache = maker.NewParseCache(len(targets))
+	}
+	for i := range targets {
+		t := targets[i]
+		current = &t
+		start := time.Now()
+		emit(event{Event: eventTargetStarted}, current)
+		m = newMaker(args, t.StructName)
+		m.GoVersion = goVersion
+		m.MethodDocs = methodDocs
+		m.Cache = cache
+		if args.Record {
+			if m.Invocation, err = recordInvocation(t.Output); err != nil {
+				fatal(err)
+			}
+		}
+		if args.MirrorEmbedding {
+			m.Promote = true
+			m.EmbeddedInterfaces = ifaces
+		}
+		if events != nil {
+			m.FileParsed = func(filename string, skipped bool, elapsed time.Duration) {
+				emit(event{Event: eventFileParsed, File: filename, Skipped: skipped, ElapsedMS: milliseconds(elapsed)}, &t)
+			}
+		}
+		if configure != nil {
+			configure(m)
+		}
+		makers[i] = m
+		if t.GOOS != "" {
+			m.GOOS, m.GOARCH = t.GOOS, t.GOARCH
+			m.SkipExcludedFiles = true
+			m.BuildConstraint = t.GOOS
+			if t.GOARCH != "" {
+				m.BuildConstraint += " && " + t.GOARCH
+			}
+		}
+		results[i], err = generate(m, args, t, files)
+		if err != nil {
+			fatal(err)
+		}
+		printWarnings(m)
+		emit(event{Event: eventTargetGenerated, ElapsedMS: milliseconds(time.Since(start)), SHA256: checksum(results[i])}, current)
+	}
+	return targets, results, makers
+}
+
+// checkArgs checks the flags of args that can be checked without reading the
+// source files.
+func checkArgs(args *cmdlineArgs) error {
+	var missing []string
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{{"-f", len(args.Files) > 0}, {"-i", args.IfaceName != ""}, {"-p", args.PkgName != ""}} {
+		if !flag.set {
+			missing = append(missing, flag.name)
+		}
+	}
+	stdin := false
+	for _, name := range args.StructType {
+		stdin = stdin || name == "-"
+	}
+	switch {
+	case len(missing) > 0:
+		return fmt.Errorf("missing required flags %s", strings.Join(missing, ", "))
+	case args.Record && stdin:
+		return fmt.Errorf("--record cannot record the structure names read from stdin")
+	case args.Examples && (args.Output == "" || len(args.Variants) > 0):
+		return fmt.Errorf("--examples requires --output and cannot be used with --variants")
+	case args.MirrorEmbedding && args.Vet:
+		return fmt.Errorf("--vet type checks every output alone and cannot be used with --mirror-embedding")
+	case args.GoVersion != "" && !version.IsValid(args.GoVersion):
+		return fmt.Errorf("invalid --go-version %q, use e.g. go1.17", args.GoVersion)
+	}
+	switch {
+	case args.Assertions != "" && args.Assert == "":
+		return fmt.Errorf("--assertions requires --assert, the import path of the source package")
+	case args.Assertions != "" && args.AssertionsPkg != "" && args.AssertionsPkg != args.PkgName && args.IfaceImport == "":
+		return fmt.Errorf("--assertions in package %s requires --iface-import, the import path of package %s", args.AssertionsPkg, args.PkgName)
+	}
+	formats, err := parseEmit(args.Emit)
+	if err != nil {
+		return err
+	}
+	for _, f := range formats {
+		switch {
+		case f.format != formatGo && f.path == "" && args.Output == "":
+			return fmt.Errorf("--emit %s requires --output or a path, e.g. %s=%s", f.format, f.format, "{{.Struct}}"+formatExtensions[f.format])
+		case f.path != "" && len(args.Variants) > 0:
+			return fmt.Errorf("--emit paths cannot be used with --variants, whose outputs are named after --output")
+		}
+	}
+	templated := false
+	for _, f := range formats {
+		templated = templated || f.format == formatTemplate
+	}
+	switch {
+	case templated && args.Template == "":
+		return fmt.Errorf("--emit template requires --template, the file of the template")
+	case !templated && args.Template != "":
+		return fmt.Errorf("--template requires --emit template and its path, e.g. template={{.Struct}}_mock.go")
+	}
+	if _, err := regexp.Compile(args.ExcludeMethods); err != nil {
+		return fmt.Errorf("invalid --exclude-methods: %v", err)
+	}
+	if _, err := regexp.Compile(args.CacheMethods); err != nil {
+		return fmt.Errorf("invalid --cache-methods: %v", err)
+	}
+	if _, err := regexp.Compile(args.ReadOnlyMethods); err != nil {
+		return fmt.Errorf("invalid --readonly-methods: %v", err)
+	}
+	return nil
+}
+
+// sourceDir returns the directory of the source path p, a file or directory.
+func sourceDir(p string) string {
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		return p
+	}
+	return filepath.Dir(p)
+}
+
+// findTargets returns the targets of args, whose structs are found in the
+// Go files of paths with m if selected by --all or --marked.
+func findTargets(m *maker.Maker, args *cmdlineArgs, paths []string) ([]maker.Target, error) {
+	structs, err := expandStdin(args.StructType, os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return structTargets(m, args, structs, paths)
+}
+
+// structTargets returns the targets of args for structs, or for the structs
+// found in the Go files of paths with m if selected by --all or --marked.
+func structTargets(m *maker.Maker, args *cmdlineArgs, structs, paths []string) ([]maker.Target, error) {
+	var err error
+	if args.All {
+		structs, err = typesWithMethods(m, paths)
+	} else if args.Marked || args.Marker != "" {
+		structs, err = markedTypes(m, paths, args.Marker)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(structs) == 0 {
+		return nil, fmt.Errorf("no structure to generate an interface for, use -s, --all or --marked")
+	}
+	targets, err := makeTargets(structs, args.IfaceName, args.Output)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Variants) > 0 {
+		return variantTargets(targets, args.Variants)
+	}
+	return targets, nil
+}
+
+type exportArgs struct {
+	// Args holds the flags of the generation, which are shared.
+	Args   cmdlineArgs
+	Dir    string `cli:"*dir"              usage:"Directory of the api module, created if needed."`
+	Module string `cli:"*module"           usage:"Module path of the api module, e.g. example.com/foo/api."`
+}
+
+// AutoHelp shows the help for the -h flag of the shared flags.
+func (a *exportArgs) AutoHelp() bool {
+	return a.Args.Help
+}
+
+// Export writes the interfaces of args, the types they refer to and a go.mod
+// file to a new module, which can be imported without depending on the
+// module of the structs. The flags named by set were given on the command
+// line.
+func Export(args *exportArgs, set map[string]bool) {
+	if err := startEvents(args.Args.Events); err != nil {
+		exit(err)
+	}
+	if err := setEnvDefaults(&args.Args, set); err != nil {
+		exit(err)
+	}
+	switch {
+	case args.Args.Config != "" || args.Args.PrintConfig:
+		exit(fmt.Errorf("export does not support --config and --print-config"))
+	case args.Args.Vet:
+		exit(fmt.Errorf("export does not support --vet, vet the exported module with go vet instead"))
+	case args.Args.Rewrite != "":
+		exit(fmt.Errorf("export does not support --rewrite, the types are copied to the exported module instead"))
+	case args.Args.Assert != "":
+		exit(fmt.Errorf("export does not support --assert, the exported module must not import the source package"))
+	case len(args.Args.Variants) > 0:
+		exit(fmt.Errorf("export does not support --variants"))
+	case len(args.Args.Emit) > 0:
+		exit(fmt.Errorf("export does not support --emit"))
+	}
+	output := args.Args.Output
+	if output == "" {
+		output = "iface.go"
+	}
+	args.Args.Output = filepath.Join(args.Dir, output)
+	targets, results, makers := generateAll(&args.Args, func(m *maker.Maker) {
+		m.CopyTypes = true
+	})
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range makers {
+		for _, name := range m.ReferencedTypes() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	files := make(map[string][]byte)
+	var order []string
+	for i, t := range targets {
+		files[t.Output] = results[i]
+		order = append(order, t.Output)
+	}
+	if len(names) > 0 {
+		// All makers parse all files to copy types, so any of them has the
+		// declarations of all the names.
+		types, err := makers[0].MakeTypes(args.Args.PkgName, names)
+		if err != nil {
+			exit(err)
+		}
+		typesFile := filepath.Join(args.Dir, "types.go")
+		if _, ok := files[typesFile]; ok {
+			exit(fmt.Errorf("output %s is the file of the copied types, use another -o", typesFile))
+		}
+		files[typesFile] = types
+		order = append(order, typesFile)
+	}
+	for _, f := range order {
+		if err := checkOverwrite(f, args.Args.Force); err != nil {
+			exit(err)
+		}
+		warnExternalImports(f, files[f], args.Dir)
+	}
+
+	if err := os.MkdirAll(args.Dir, 0755); err != nil {
+		exit(err)
+	}
+	// An existing go.mod file is kept, as it may have been completed with
+	// the requirements of the module.
+	goMod := filepath.Join(args.Dir, "go.mod")
+	if _, err := os.Stat(goMod); os.IsNotExist(err) {
+		content := "module " + args.Module + "\n"
+		if v := makers[0].GoVersion; v != "" {
+			content += "\ngo " + strings.TrimPrefix(v, "go") + "\n"
+		}
+		if err := ioutil.WriteFile(goMod, []byte(content), 0644); err != nil {
+			exit(err)
+		}
+		emit(event{Event: eventFileWritten, File: goMod}, nil)
+	}
+	for _, f := range order {
+		if err := ioutil.WriteFile(f, files[f], 0644); err != nil {
+			exit(err)
+		}
+		emit(event{Event: eventFileWritten, File: f}, nil)
+	}
+	if args.Args.Stats {
+		printStats(os.Stderr, targets, makers)
+	}
+}
+
+// warnExternalImports warns about the imports of the generated file f with
+// src that are not in the standard library, as the go.mod file in dir does
+// not require their modules.
+func warnExternalImports(f string, src []byte, dir string) {
+	a, err := parser.ParseFile(token.NewFileSet(), f, src, parser.ImportsOnly)
+	if err != nil {
+		return
+	}
+	for _, i := range a.Imports {
+		path, _ := strconv.Unquote(i.Path.Value)
+		if first := strings.SplitN(path, "/", 2)[0]; strings.Contains(first, ".") {
+			log.Printf("warning: %s imports %s, run go mod tidy in %s to require its module", f, path, dir)
+		}
+	}
+}
+
+func newMaker(args *cmdlineArgs, structName string) *maker.Maker {
+	m := &maker.Maker{
+		StructName:          structName,
+		CopyDocs:            args.CopyDocs,
+		DuplicatePolicy:     maker.DuplicatePolicy(args.Duplicates),
+		BuildTags:           args.Tags,
+		Promote:             args.Promote,
+		ContinueOnError:     args.ContinueOnError,
+		ParamComments:       args.ParamComments,
+		NoResultNames:       args.NoResultNames,
+		LineEndings:         maker.LineEndings(args.LineEndings),
+		MaxFileSize:         args.MaxFileSize,
+		SkipLargeFiles:      args.SkipLargeFiles,
+		MaxFiles:            args.MaxFiles,
+		Workers:             args.Workers,
+		Multiplexer:         args.Multiplexer,
+		Unimplemented:       maker.UnimplementedMode(args.Unimplemented),
+		CopyTypeDoc:         args.CopyTypeDoc,
+		IfaceComment:        args.IfaceComment,
+		Comment:             args.Comment,
+		TargetGoVersion:     args.GoVersion,
+		AssertImport:        args.Assert,
+		SeparateAssertion:   args.Assertions != "",
+		CopyBuildConstraint: args.CopyBuild,
+	}
+	for _, d := range args.Decorators {
+		m.Decorators = append(m.Decorators, maker.Decorator(d))
+	}
+	if args.ExcludeMethods != "" {
+		// Validated by Run.
+		m.ExcludeMethods = regexp.MustCompile(args.ExcludeMethods)
+	}
+	if args.CacheMethods != "" {
+		// Validated by Run.
+		m.CacheMethods = regexp.MustCompile(args.CacheMethods)
+	}
+	if args.ReadOnlyMethods != "" {
+		m.ReadOnlyMethods = regexp.MustCompile(args.ReadOnlyMethods)
 	}
 	if args.AddImport != "" {
-		maker.AddImport("", args.AddImport)
+		m.AddImport("", args.AddImport)
 	}
 	if args.Rewrite != "" {
-		maker.SourcePackage(args.Rewrite)
+		m.SourcePackage(args.Rewrite)
 	}
+	return m
+}
 
-	allFiles, err := maker.GetGoFiles(args.Files...)
-	if err != nil {
-		log.Fatal(err.Error())
+// generate returns the code of the interface of target t, whose struct is
+// declared in the Go files of paths.
+func generate(m *maker.Maker, args *cmdlineArgs, t maker.Target, paths []string) ([]byte, error) {
+	if m.LineEndings == maker.AutoLineEndings && t.Output != "" {
+		// Keep the line endings of an existing output file, so that
+		// regenerating it on another operating system does not change them.
+		if existing, err := ioutil.ReadFile(t.Output); err == nil {
+			m.LineEndings = maker.DetectLineEndings(existing)
+		}
 	}
 
-	err = maker.ParseFiles(allFiles...)
+	if err := m.ParsePaths(paths...); err != nil {
+		return nil, err
+	}
+	result, err := m.MakeInterface(args.PkgName, t.IfaceName)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 
-	result, err := maker.MakeInterface(args.PkgName, args.IfaceName)
+	if args.Vet {
+		filename := t.Output
+		if filename == "" {
+			filename = "ifacemaker_generated.go"
+		}
+		if err := m.Vet(result, filename); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readDocsFile reads the doc comments of --docs-file, a JSON object or, for
+// the .yaml and .yml extensions, a YAML mapping of the methods to their docs.
+func readDocsFile(filename string) (map[string]string, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var docs map[string]string
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &docs)
+	default:
+		err = json.Unmarshal(b, &docs)
+	}
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, fmt.Errorf("invalid --docs-file %s: %v", filename, err)
 	}
+	return docs, nil
+}
 
-	if args.Output == "" {
-		fmt.Println(string(result))
-	} else {
-		ioutil.WriteFile(args.Output, result, 0644)
+// typesWithMethods returns the exported types declared with methods in the Go
+// files of paths.
+func typesWithMethods(m *maker.Maker, paths []string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	err := m.WalkGoFiles(paths, func(f string) error {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		declarations, err := m.ParseDeclarations(src, f)
+		if _, ok := err.(*maker.ParseError); ok && m.ContinueOnError {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for name := range declarations {
+			if token.IsExported(name) && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(names)
+	return names, nil
+}
 
+// expandStdin replaces a - in names with the names read from stdin, one per
+// line. Empty lines are ignored.
+func expandStdin(names []string, stdin io.Reader) ([]string, error) {
+	var expanded []string
+	for _, name := range names {
+		if name != "-" {
+			expanded = append(expanded, name)
+			continue
+		}
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				expanded = append(expanded, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed reading the structure names from stdin: %v", err)
+		}
+	}
+	return expanded, nil
 }
 
-func main() {
-	cli.Run(&cmdlineArgs{}, func(ctx *cli.Context) error {
-		argv := ctx.Argv().(*cmdlineArgs)
-		Run(argv)
+// markedTypes returns the types marked for generating an interface in the Go
+// files of paths, see maker.ParseMarkedTypes.
+func markedTypes(m *maker.Maker, paths []string, marker string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	err := m.WalkGoFiles(paths, func(f string) error {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		marked, err := m.ParseMarkedTypes(src, f, marker)
+		if _, ok := err.(*maker.ParseError); ok && m.ContinueOnError {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range marked {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// makeTargets expands the interface name and output templates for each of
+// the structs.
+func makeTargets(structs []string, iface, output string) ([]maker.Target, error) {
+	ifaceTmpl, err := template.New("iface").Option("missingkey=error").Parse(iface)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface name template: %v", err)
+	}
+	outputTmpl, err := template.New("output").Option("missingkey=error").Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	var targets []maker.Target
+	for _, s := range structs {
+		data := struct{ Struct string }{s}
+		var i, o bytes.Buffer
+		if err := ifaceTmpl.Execute(&i, data); err != nil {
+			return nil, fmt.Errorf("invalid interface name template: %v", err)
+		}
+		if err := outputTmpl.Execute(&o, data); err != nil {
+			return nil, fmt.Errorf("invalid output template: %v", err)
+		}
+		targets = append(targets, maker.Target{StructName: s, IfaceName: i.String(), Output: o.String()})
+	}
+	return targets, nil
+}
+
+// variantTargets returns the targets of each of the build configurations in
+// variants, e.g. linux or windows/amd64, for each of the targets. The output
+// files are named after the configuration, e.g. human_iface_linux.go.
+func variantTargets(targets []maker.Target, variants []string) ([]maker.Target, error) {
+	var result []maker.Target
+	for _, t := range targets {
+		if t.Output == "" {
+			return nil, fmt.Errorf("--variants requires --output, as a file is written for each variant")
+		}
+		for _, v := range variants {
+			parts := strings.Split(v, "/")
+			if len(parts) > 2 || parts[0] == "" || len(parts) == 2 && parts[1] == "" {
+				return nil, fmt.Errorf("invalid variant %q, use GOOS or GOOS/GOARCH", v)
+			}
+			variant := t
+			variant.GOOS = parts[0]
+			if len(parts) == 2 {
+				variant.GOARCH = parts[1]
+			}
+			variant.Output = strings.TrimSuffix(t.Output, ".go") + "_" + strings.Join(parts, "_") + ".go"
+			result = append(result, variant)
+		}
+	}
+	return result, nil
+}
+
+// checkOverwrite refuses to overwrite an existing output file that does not
+// carry the generated code comment, unless force is true, as it is likely
+// hand-written and the output path was mistyped.
+func checkOverwrite(output string, force bool) error {
+	existing, err := ioutil.ReadFile(output)
+	if os.IsNotExist(err) || force {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(existing)) == 0 || maker.IsGenerated(existing) || isGeneratedDoc(existing) {
+		return nil
+	}
+	return fmt.Errorf("refusing to overwrite %s: it does not look generated, use --force to overwrite it anyway", output)
+}
+
+// stopProfiling finishes the profiles requested on the command line.
+var stopProfiling = func() {}
+
+// exit stops profiling and exits with err, so that the profiles of failed
+// runs are written too.
+func exit(err error) {
+	fail(err, nil)
+}
+
+// fail is exit for an error of the target t, which may be nil.
+func fail(err error, t *maker.Target) {
+	emit(event{Event: eventDiagnostic, Severity: "error", Message: err.Error()}, t)
+	stopProfiling()
+	removeTempDirs()
+	log.Fatal(err.Error())
+}
+
+// startProfiling starts the CPU profile and the execution trace, and sets
+// stopProfiling to finish them and write the memory profile.
+func startProfiling(args *cmdlineArgs) error {
+	var stops []func() error
+	stopProfiling = func() {
+		for _, stop := range stops {
+			if err := stop(); err != nil {
+				log.Printf("warning: %s", err)
+			}
+		}
+		stops = nil
+	}
+	if args.CPUProfile != "" {
+		f, err := os.Create(args.CPUProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+	if args.Trace != "" {
+		f, err := os.Create(args.Trace)
+		if err != nil {
+			return err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return err
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+	if args.MemProfile != "" {
+		stops = append(stops, func() error {
+			f, err := os.Create(args.MemProfile)
+			if err != nil {
+				return err
+			}
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+	return nil
+}
+
+// joinStdinFlags joins a -s or --struct flag followed by - into -s=-, as the
+// command line parser rejects a lone dash.
+func joinStdinFlags(args []string) []string {
+	var joined []string
+	for i := 0; i < len(args); i++ {
+		if (args[i] == "-s" || args[i] == "--struct") && i+1 < len(args) && args[i+1] == "-" {
+			joined = append(joined, args[i]+"=-")
+			i++
+			continue
+		}
+		joined = append(joined, args[i])
+	}
+	return joined
+}
+
+func main() {
+	commandLine = joinStdinFlags(os.Args[1:])
+	if err := commandTree().Run(commandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// commandTree returns the commands of ifacemaker, the generation of the
+// interfaces at the root.
+func commandTree() *cli.Command {
+	root := &cli.Command{
+		Name: os.Args[0],
+		Argv: func() interface{} { return &cmdlineArgs{} },
+		Fn: func(ctx *cli.Context) error {
+			argv := ctx.Argv().(*cmdlineArgs)
+			if err := startProfiling(argv); err != nil {
+				exit(err)
+			}
+			Run(argv, commandLineFlags(ctx, argv))
+			stopProfiling()
+			return nil
+		},
+	}
+	export := &cli.Command{
+		Name: "export",
+		Desc: "Generate a module with the interfaces and copies of the types they refer to",
+		Argv: func() interface{} { return &exportArgs{} },
+		Fn: func(ctx *cli.Context) error {
+			argv := ctx.Argv().(*exportArgs)
+			if err := startProfiling(&argv.Args); err != nil {
+				exit(err)
+			}
+			Export(argv, commandLineFlags(ctx, &argv.Args))
+			stopProfiling()
+			return nil
+		},
+	}
+	config := &cli.Command{
+		Name: "config",
+		Desc: "Work with the config files of --config",
+		Fn: func(ctx *cli.Context) error {
+			ctx.WriteUsage()
+			return nil
+		},
+	}
+	schema := &cli.Command{
+		Name: "schema",
+		Desc: "Print the JSON Schema of the config files",
+		Fn: func(ctx *cli.Context) error {
+			s, err := configSchema()
+			if err != nil {
+				return err
+			}
+			e := json.NewEncoder(os.Stdout)
+			e.SetEscapeHTML(false)
+			e.SetIndent("", "  ")
+			return e.Encode(s)
+		},
+	}
+	validate := &cli.Command{
+		Name:        "validate",
+		Desc:        "Check config files for errors without generating anything",
+		Text:        "Usage: ifacemaker config validate FILE...",
+		Argv:        func() interface{} { return &struct{ cli.Helper }{} },
+		CanSubRoute: true,
+		NumArg:      cli.AtLeast(1),
+		Fn: func(ctx *cli.Context) error {
+			valid := true
+			for _, filename := range ctx.Args() {
+				for _, problem := range validateConfig(filename) {
+					fmt.Fprintln(os.Stderr, problem)
+					valid = false
+				}
+			}
+			if !valid {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	regenerate := &cli.Command{
+		Name:        "regen",
+		Desc:        "Generate files again with the arguments recorded by --record",
+		Text:        "Usage: ifacemaker regen FILE...",
+		Argv:        func() interface{} { return &struct{ cli.Helper }{} },
+		CanSubRoute: true,
+		NumArg:      cli.AtLeast(1),
+		Fn: func(ctx *cli.Context) error {
+			return regen(ctx.Args())
+		},
+	}
+	return cli.Root(root, cli.Tree(export), cli.Tree(config, cli.Tree(schema), cli.Tree(validate)), cli.Tree(regenerate))
 }
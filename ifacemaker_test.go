@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mlctrez/ifacemaker/maker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOverwrite(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name, content string
+		force         bool
+		refused       bool
+	}{
+		{"missing.go", "", false, false},
+		{"empty.go", " \n", false, false},
+		{"generated.go", "// Code generated by ifacemaker. DO NOT EDIT.\n\npackage x\n", false, false},
+		{"generated_other.go", "//go:build linux\n\n// Code generated by mockgen. DO NOT EDIT.\n\npackage x\n", false, false},
+		{"generated.md", "<!-- Code generated by ifacemaker. DO NOT EDIT. -->\n\n# I\n", false, false},
+		{"generated.json", "{\"generated\": \"Code generated by ifacemaker. DO NOT EDIT.\"}\n", false, false},
+		{"hand.go", "package x\n\n// Code generated by ifacemaker. DO NOT EDIT.\n", false, true},
+		{"hand.json", "{\"generated\": \"by hand\"}\n", false, true},
+		{"hand.md", "# I\n", false, true},
+		{"forced.go", "package x\n", true, false},
+	} {
+		filename := filepath.Join(dir, test.name)
+		if test.content != "" {
+			require.Nil(ioutil.WriteFile(filename, []byte(test.content), 0644))
+		}
+		err := checkOverwrite(filename, test.force)
+		if test.refused {
+			require.EqualError(err, "refusing to overwrite "+filename+": it does not look generated, use --force to overwrite it anyway")
+			continue
+		}
+		require.Nil(err, test.name)
+	}
+}
+
+// TestReadmeUsage checks that the help output in the README is up to date.
+func TestReadmeUsage(t *testing.T) {
+	require := require.New(t)
+
+	var b bytes.Buffer
+	require.Nil(commandTree().RunWith([]string{"--help"}, &b, nil))
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+
+	readme, err := ioutil.ReadFile("README.md")
+	require.Nil(err)
+	const start, end = "$ ifacemaker --help\n", "\n$\n```"
+	i := strings.Index(string(readme), start)
+	require.True(i >= 0, "no help output in the README")
+	help := string(readme[i+len(start):])
+	j := strings.Index(help, end)
+	require.True(j >= 0, "no end of the help output in the README")
+	require.Equal(strings.Join(lines, "\n"), help[:j], "update the help output in the README")
+}
+
+func TestPrintStats(t *testing.T) {
+	require := require.New(t)
+
+	m := &maker.Maker{StructName: "Store", ExcludeMethods: regexp.MustCompile("^Set$")}
+	require.Nil(m.ParseSource([]byte(`package store
+
+type Store struct{}
+
+func (s *Store) Get(key string) string { return "" }
+func (s *Store) Set(key, value string) {}
+func (s *Store) item(key string) *item { return nil }
+
+type item struct{}
+
+func (s *Store) Item(key string) *item { return nil }
+`), "store.go"))
+	_, err := m.MakeInterface("store", "IStore")
+	require.Nil(err)
+
+	var b bytes.Buffer
+	targets := []maker.Target{{StructName: "Store", IfaceName: "IStore", GOOS: "linux"}}
+	printStats(&b, targets, []*maker.Maker{m})
+	require.Equal(`IStore (linux) from Store: 1 files scanned, 1 parsed, 0 skipped as unrelated, 0 excluded by the build, 0 failed to parse
+	1 methods included, 3 skipped: 1 unexported, 1 filtered, 0 duplicate, 0 ambiguous, 1 unexported types
+`, b.String())
+}
+
+func TestReadDocsFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name, content string
+		docs          map[string]string
+		err           string
+	}{
+		{"docs.json", `{"Get": "Get returns the value of key.", "Store.Set": "Set sets key."}`,
+			map[string]string{"Get": "Get returns the value of key.", "Store.Set": "Set sets key."}, ""},
+		{"docs.yaml", "# Docs of the store.\nGet: Get returns the value of key.\nStore.Set: |\n  Set sets key.\n\n  It may block.\n",
+			map[string]string{"Get": "Get returns the value of key.", "Store.Set": "Set sets key.\n\nIt may block.\n"}, ""},
+		{"docs.yml", "Get: >-\n  Get returns\n  the value.\n", map[string]string{"Get": "Get returns the value."}, ""},
+		{"nested.yaml", "Get:\n  Get: nested\n", nil, "cannot unmarshal !!map into string"},
+		{"list.yaml", "Get: [a, b]\n", nil, "cannot unmarshal !!seq into string"},
+		{"invalid.yaml", "Get: x\n Set: y\n", nil, "mapping values are not allowed in this context"},
+		{"yaml.json", "Get: x\n", nil, "invalid character"},
+	} {
+		filename := filepath.Join(dir, test.name)
+		require.Nil(ioutil.WriteFile(filename, []byte(test.content), 0644))
+		docs, err := readDocsFile(filename)
+		if test.err != "" {
+			require.NotNil(err, test.name)
+			require.Contains(err.Error(), "invalid --docs-file "+filename+": ", test.name)
+			require.Contains(err.Error(), test.err, test.name)
+			continue
+		}
+		require.Nil(err, test.name)
+		require.Equal(test.docs, docs, test.name)
+	}
+}
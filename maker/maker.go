@@ -4,17 +4,30 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"go/importer"
 	"go/parser"
 	"go/printer"
+	"go/scanner"
 	"go/token"
+	"go/types"
+	"go/version"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
-	"unicode"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"golang.org/x/tools/imports"
@@ -24,20 +37,440 @@ import (
 type Maker struct {
 	// StructName is the name of the struct from which to generate an interface.
 	StructName string
-	// If CopyDocs is true, doc comments will be copied to the generated interface.
+	// If CopyDocs is true, doc comments will be copied verbatim to the generated
+	// interface.
 	CopyDocs bool
+	// MethodDocs are doc comments, without the comment markers, for the
+	// methods whose doc comment is missing or not copied. They are keyed by
+	// the name of the method, or by the receiver type and method name, e.g.
+	// Client.Get, which takes precedence.
+	MethodDocs map[string]string
+	// If CopyTypeDoc is true, the doc comment of the struct is copied to the
+	// interface.
+	CopyTypeDoc bool
+	// IfaceComment is the doc comment of the interface, without the comment
+	// markers. It comes before the doc comment of the struct.
+	IfaceComment string
+	// Comment is a comment added to the top of the generated file, without
+	// the comment markers.
+	Comment string
+	// Invocation, if set, records how the file was generated in an
+	// //ifacemaker:invocation line after the generated comment, so that it
+	// can be regenerated. It must be a single line, see ReadInvocation.
+	Invocation string
+	// If CopyTypes is true, the type declarations of the parsed files are
+	// kept, so that MakeTypes can copy those referenced by the interface.
+	CopyTypes bool
+	// AssertImport, if set, is the import path of the source package. The
+	// generated code then asserts that the struct implements the interface,
+	// as it does with SourcePackage, without rewriting the signatures.
+	AssertImport string
+	// If SeparateAssertion is true, the assertion of AssertImport is left out
+	// of the generated code, to be written with those of other interfaces by
+	// MakeAssertions, see Assertion.
+	SeparateAssertion bool
+	// DuplicatePolicy decides which declaration is used when a method is
+	// declared in more than one source file. The default is DuplicateFirst.
+	DuplicatePolicy DuplicatePolicy
+	// BuildTags are the additional build tags of the target build
+	// configuration used by DuplicateBuild.
+	BuildTags []string
+	// GOOS and GOARCH are the operating system and architecture of the
+	// target build configuration. The default is that of build.Default,
+	// except that with GOOS alone the configuration is every architecture
+	// of GOOS, so a file must be included in the builds for all of them.
+	GOOS, GOARCH string
+	// If SkipExcludedFiles is true, the source files excluded from the target
+	// build configuration by their name or build constraints are skipped.
+	SkipExcludedFiles bool
+	// BuildConstraint, if set, is the expression of a //go:build line added
+	// to the generated file, e.g. linux && amd64. The equivalent // +build
+	// lines are added too if TargetGoVersion is older than go1.17.
+	BuildConstraint string
+	// If CopyBuildConstraint is true and BuildConstraint is empty, the
+	// //go:build line shared by all files declaring the methods of the
+	// interface is added to the generated file. The constraint of a file
+	// includes that implied by a _GOOS or _GOARCH suffix of its name.
+	CopyBuildConstraint bool
+	// If Promote is true, methods promoted from embedded fields declared in
+	// the parsed files are included in the generated interface.
+	Promote bool
+	// EmbeddedInterfaces are the generated interfaces of types the struct may
+	// embed, by type name. If Promote is true, the interface embeds those of
+	// the embedded fields instead of listing the methods promoted from them,
+	// unless some of them are shadowed or ambiguous.
+	EmbeddedInterfaces map[string]string
+	// If ContinueOnError is true, ParseFiles skips files that fail to parse
+	// with a warning instead of failing.
+	ContinueOnError bool
+	// If ParamComments is true, comments inside parameter and result lists
+	// are copied to the generated interface.
+	ParamComments bool
+	// LineEndings selects the line endings of the generated code.
+	// The default is LF.
+	LineEndings LineEndings
+	// MaxFileSize is the size in bytes above which GetGoFiles warns about
+	// files found in directories, or skips them if SkipLargeFiles is true.
+	// Zero means no limit.
+	MaxFileSize int64
+	// If SkipLargeFiles is true, GetGoFiles skips files found in directories
+	// that are larger than MaxFileSize.
+	SkipLargeFiles bool
+	// MaxFiles is the maximum number of files GetGoFiles returns.
+	// Zero means no limit.
+	MaxFiles int
+	// NoResultNames drops the names of the results, e.g. (n int, err error)
+	// becomes (int, error).
+	NoResultNames bool
+	// ExcludeMethods, if set, selects the methods left out of the interface
+	// by name.
+	ExcludeMethods *regexp.Regexp
+	// Unimplemented, if set, adds a struct named Unimplemented followed by
+	// the interface name, implementing the interface with methods that fail.
+	Unimplemented UnimplementedMode
+	// If Multiplexer is true, a slice type named after the interface with the
+	// suffix Multiplexer is added, forwarding every call to all its elements.
+	Multiplexer bool
+	// Decorators lists the wrappers of the interface added to the
+	// generated code.
+	Decorators []Decorator
+	// CacheMethods selects the methods cached by DecoratorCache, in addition
+	// to the methods annotated with //ifacemaker:cache.
+	CacheMethods *regexp.Regexp
+	// ReadOnlyMethods selects the methods DecoratorLocked lets run
+	// concurrently, in addition to the methods annotated with
+	// //ifacemaker:readonly.
+	ReadOnlyMethods *regexp.Regexp
+	// Workers is the number of files ParseFiles reads and parses
+	// concurrently. Zero means GOMAXPROCS.
+	Workers int
+	// Cache, if not nil, shares the files read and parsed by ParseFiles and
+	// ParsePaths with the other makers using it, so that the targets
+	// generated from the same files parse them once.
+	Cache *ParseCache
+	// FileParsed, if not nil, is called by ParseFiles for every file added,
+	// in the order of the files, with the time spent reading and parsing it.
+	// skipped is true if only its package clause was parsed, as it does not
+	// mention the struct.
+	FileParsed func(filename string, skipped bool, elapsed time.Duration)
+	// GoVersion is the Go language version of the sources, e.g. "go1.21".
+	// Sources using newer syntax are rejected, and Vet type checks with it.
+	// If empty, any syntax is accepted.
+	GoVersion string
+	// TargetGoVersion is the Go version the generated code must build with,
+	// if it differs from GoVersion. Newer features are replaced by compatible
+	// alternatives where possible, e.g. interface{} for any, and rejected
+	// otherwise.
+	TargetGoVersion string
 
 	fset *token.FileSet
 
-	importsByPath        map[string]*importedPkg
-	importsByAlias       map[string]*importedPkg
-	imports              []*importedPkg
-	methods              []*method
-	methodNames          map[string]struct{}
+	importsByPath  map[string]*importedPkg
+	importsByAlias map[string]*importedPkg
+	imports        []*importedPkg
+	addedImports   []*importedPkg
+	methods        []*method
+	methodNames    map[string]*method
+	ifaceMethods   []*method
+	// ifaceTypeParams are the printed type parameters of the interface.
+	ifaceTypeParams string
+	// ifaceCode is the code returned by MakeInterface, before converting
+	// its line endings.
+	ifaceCode []byte
+	// errorsName qualifies the standard errors package in the generated
+	// code, see stdImport.
+	errorsName string
+	// ifaceEmbeds are the interfaces embedded by the generated interface, and
+	// mirrored the methods they provide, set by methodSet.
+	ifaceEmbeds  []string
+	mirrored     map[*method]bool
+	declarations map[string]struct{}
+	// typeExprs are the types of the type declarations by name, and aliases
+	// the names of those declaring aliases.
+	typeExprs       map[string]ast.Expr
+	aliases         map[string]bool
+	typeParams      *ast.FieldList
+	typeParamsScope *signatureScope
+	// typeDoc is the doc comment of the struct, set if CopyTypeDoc is true.
+	typeDoc []string
+	// typeDecls are the type declarations by name, valueDecls the constant
+	// and variable declarations by the names they declare, and typedConsts
+	// the constant declarations by the names of their types, set if
+	// CopyTypes is true.
+	typeDecls         map[string]*typeDecl
+	valueDecls        map[string]*valueDecl
+	typedConsts       map[string][]*valueDecl
+	embedded          map[string][]ast.Expr
+	fields            map[string][]string
+	typeMethods       map[string][]*method
+	warnings          []string
+	stats             Stats
+	sourceLineEndings LineEndings
+	packageNames      []string
+	packageFiles      map[string][]string
+	// dotImports is set if a file declaring methods of the struct has a dot
+	// import, so that the declarations of every file are needed.
+	dotImports bool
+	// current is the node being processed, for the position in panic errors.
+	current              ast.Node
 	srcPackage           string
 	omitGeneratedComment bool
 }
 
+// DuplicatePolicy decides what happens when a method is declared in more than
+// one source file, e.g. in both foo_linux.go and foo_windows.go.
+type DuplicatePolicy string
+
+const (
+	// DuplicateFirst keeps the declaration from the first parsed file.
+	DuplicateFirst DuplicatePolicy = "first"
+	// DuplicateError fails the generation.
+	DuplicateError DuplicatePolicy = "error"
+	// DuplicateBuild keeps the declaration from the file matching the target
+	// build configuration, i.e. GOOS, GOARCH and the build tags.
+	DuplicateBuild DuplicatePolicy = "build"
+	// DuplicateIdentical requires all declarations to have the same signature.
+	DuplicateIdentical DuplicatePolicy = "identical"
+)
+
+// UnimplementedMode decides how the methods of the Unimplemented struct fail.
+type UnimplementedMode string
+
+const (
+	// UnimplementedError returns an error from methods whose last result is
+	// an error, and panics in the others.
+	UnimplementedError UnimplementedMode = "error"
+	// UnimplementedPanic panics in all methods.
+	UnimplementedPanic UnimplementedMode = "panic"
+)
+
+// Decorator is a wrapper of the interface, implementing it by calling a
+// wrapped implementation.
+type Decorator string
+
+const (
+	// DecoratorCache caches the results of the selected methods for a TTL.
+	DecoratorCache Decorator = "cache"
+	// DecoratorLocked serializes the calls with a mutex, except that the
+	// read-only methods may run concurrently.
+	DecoratorLocked Decorator = "locked"
+)
+
+// LineEndings selects the line endings of the generated code.
+type LineEndings string
+
+const (
+	// LF ends lines with "\n".
+	LF LineEndings = "lf"
+	// CRLF ends lines with "\r\n".
+	CRLF LineEndings = "crlf"
+	// AutoLineEndings uses the line endings of the first parsed source file.
+	AutoLineEndings LineEndings = "auto"
+)
+
+// DetectLineEndings returns CRLF if b contains a "\r\n" line ending, LF otherwise.
+func DetectLineEndings(b []byte) LineEndings {
+	if bytes.Contains(b, []byte("\r\n")) {
+		return CRLF
+	}
+	return LF
+}
+
+// ParseError is returned when a source file cannot be parsed.
+type ParseError struct {
+	Filename string
+	// Errors lists the syntax errors with their positions, if available.
+	Errors scanner.ErrorList
+	Err    error
+}
+
+func newParseError(filename string, err error) *ParseError {
+	e := &ParseError{Filename: filename, Err: err}
+	if list, ok := err.(scanner.ErrorList); ok {
+		e.Errors = list
+	}
+	return e
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parsing %s failed:%s", e.Filename, e.details())
+}
+
+// details lists every syntax error on its own line, instead of only the
+// first one as scanner.ErrorList does.
+func (e *ParseError) details() string {
+	if len(e.Errors) == 0 {
+		return " " + e.Err.Error()
+	}
+	var lines []string
+	for _, err := range e.Errors {
+		lines = append(lines, "\n\t"+err.Error())
+	}
+	return strings.Join(lines, "")
+}
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16BEBOM = []byte{0xfe, 0xff}
+	utf16LEBOM = []byte{0xff, 0xfe}
+)
+
+// checkEncoding returns a ParseError if src is not UTF-8 encoded, with the
+// first invalid byte of each line, instead of the syntax errors the parser
+// reports for them.
+func checkEncoding(filename string, src []byte) error {
+	if bytes.HasPrefix(src, utf16BEBOM) || bytes.HasPrefix(src, utf16LEBOM) {
+		return newParseError(filename, errors.New("the file is UTF-16 encoded, convert it to UTF-8"))
+	}
+	if utf8.Valid(src) {
+		return nil
+	}
+	var list scanner.ErrorList
+	pos := token.Position{Filename: filename, Line: 1, Column: 1}
+	reported := 0
+	for pos.Offset < len(src) {
+		r, size := utf8.DecodeRune(src[pos.Offset:])
+		if r == utf8.RuneError && size == 1 && reported < pos.Line {
+			list.Add(pos, fmt.Sprintf("invalid UTF-8 byte %#x, the file must be UTF-8 encoded", src[pos.Offset]))
+			reported = pos.Line
+		}
+		pos.Offset += size
+		pos.Column += size
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		}
+	}
+	return newParseError(filename, list)
+}
+
+// toolVersion returns the version of ifacemaker for bug reports.
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// recoverPanic turns a panic while processing filename into an error naming
+// the file and the position of the current node, so that a bug triggered by
+// unusual syntax does not crash a whole batch run.
+func (m *Maker) recoverPanic(err *error, filename string) {
+	// The current node is not kept once it has been processed, so that
+	// the AST it belongs to can be released.
+	current := m.current
+	m.current = nil
+	r := recover()
+	if r == nil {
+		return
+	}
+	position := filename
+	if current != nil && current.Pos().IsValid() {
+		position = m.fset.Position(current.Pos()).String()
+	}
+	*err = panicError(position, r)
+}
+
+func panicError(position string, r interface{}) error {
+	return fmt.Errorf("ifacemaker %s failed processing %s: %v; this is a bug, please report it including the source at this position",
+		toolVersion(), position, r)
+}
+
+const (
+	// genericsVersion is the first Go version supporting type parameters.
+	genericsVersion = "go1.18"
+	// joinVersion is the first Go version with errors.Join.
+	joinVersion = "go1.20"
+	// goBuildVersion is the first Go version reading //go:build lines;
+	// older versions need the equivalent // +build lines.
+	goBuildVersion = "go1.17"
+)
+
+// targetGoVersion returns the Go version of the generated code.
+func (m *Maker) targetGoVersion() string {
+	if m.TargetGoVersion != "" {
+		return m.TargetGoVersion
+	}
+	return m.GoVersion
+}
+
+// targetsBefore reports whether the generated code must build with a Go
+// version older than v.
+func (m *Maker) targetsBefore(v string) bool {
+	target := m.targetGoVersion()
+	return target != "" && version.Compare(target, v) < 0
+}
+
+// checkGoVersion rejects syntax in astFile that is newer than GoVersion.
+// Only the syntax relevant to interface generation is checked.
+func (m *Maker) checkGoVersion(astFile *ast.File) error {
+	if m.GoVersion == "" || version.Compare(m.GoVersion, genericsVersion) >= 0 {
+		return nil
+	}
+	var generic ast.Node
+	ast.Inspect(astFile, func(n ast.Node) bool {
+		if generic != nil {
+			return false
+		}
+		switch t := n.(type) {
+		case *ast.TypeSpec:
+			if t.TypeParams != nil {
+				generic = t.TypeParams
+			}
+		case *ast.FuncType:
+			if t.TypeParams != nil {
+				generic = t.TypeParams
+			}
+		case *ast.FuncDecl:
+			if len(receiverTypeParams(t)) > 0 {
+				generic = t.Recv
+			}
+		case *ast.IndexListExpr:
+			generic = t
+		case *ast.UnaryExpr:
+			if t.Op == token.TILDE {
+				generic = t
+			}
+		}
+		return generic == nil
+	})
+	if generic != nil {
+		return fmt.Errorf("%v: type parameters require %s, but the Go version is %s",
+			m.fset.Position(generic.Pos()), genericsVersion, m.GoVersion)
+	}
+	return nil
+}
+
+// ModuleGoVersion returns the Go version of the go directive in the go.mod
+// file of the module containing dir, e.g. "go1.21". It returns an empty
+// string if there is no go.mod file or it has no go directive.
+func ModuleGoVersion(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[0] == "go" {
+					return "go" + fields[1], nil
+				}
+			}
+			return "", nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
 // errorAlias formats the alias for error messages.
 // It replaces an empty string with "<none>".
 func errorAlias(alias string) string {
@@ -48,6 +481,10 @@ func errorAlias(alias string) string {
 }
 
 func (m *Maker) init() {
+	if m.fset == nil && m.Cache != nil {
+		// The positions of the shared files are those of the cache.
+		m.fset = m.Cache.fset
+	}
 	if m.fset == nil {
 		m.fset = token.NewFileSet()
 	}
@@ -58,198 +495,2936 @@ func (m *Maker) init() {
 		m.importsByAlias = make(map[string]*importedPkg)
 	}
 	if m.methods == nil {
-		m.methodNames = make(map[string]struct{})
+		m.methodNames = make(map[string]*method)
+	}
+	if m.declarations == nil {
+		m.declarations = make(map[string]struct{})
+	}
+	if m.typeExprs == nil {
+		m.typeExprs = make(map[string]ast.Expr)
+		m.aliases = make(map[string]bool)
+	}
+	if m.embedded == nil {
+		m.embedded = make(map[string][]ast.Expr)
+	}
+	if m.fields == nil {
+		m.fields = make(map[string][]string)
+	}
+	if m.typeMethods == nil {
+		m.typeMethods = make(map[string][]*method)
+	}
+	if m.packageFiles == nil {
+		m.packageFiles = make(map[string][]string)
 	}
 }
 
 func (m *Maker) AddImport(alias, path string) {
 	i := &importedPkg{Alias: alias, Path: path}
 	m.imports = append(m.imports, i)
+	m.addedImports = append(m.addedImports, i)
 }
 
 func (m *Maker) SourcePackage(p string) {
 	m.srcPackage = p
 }
 
+// assertPackage returns the name qualifying the struct in the assertion that
+// it implements the interface, or "" if there is none.
+func (m *Maker) assertPackage() string {
+	switch {
+	case m.srcPackage != "":
+		return m.srcPackage
+	case m.AssertImport != "" && len(m.packageNames) > 0:
+		return m.packageNames[0]
+	}
+	return ""
+}
+
+// assertImport returns the import of the source package needed by the
+// assertion, or nil if it is imported already.
+func (m *Maker) assertImport() *importedPkg {
+	if m.AssertImport == "" {
+		return nil
+	}
+	for _, i := range m.imports {
+		if i.Path == m.AssertImport {
+			return nil
+		}
+	}
+	alias := m.assertPackage()
+	if alias == path.Base(m.AssertImport) {
+		alias = ""
+	}
+	return &importedPkg{Path: m.AssertImport, Alias: alias}
+}
+
+// Assertion is the assertion that a struct implements an interface, for
+// MakeAssertions.
+type Assertion struct {
+	// Import is the import path of the package of the struct, and Package
+	// its name.
+	Import, Package string
+	Struct          string
+	// IfaceImport, if set, is the import path of the package of the
+	// interface, and IfacePackage its name. The interface is otherwise
+	// declared in the package of the assertions.
+	IfaceImport, IfacePackage string
+	Iface                     string
+}
+
+// Assertion returns the assertion that the struct implements the interface
+// ifaceName, in its package. MakeInterface must be called first, with
+// AssertImport set.
+func (m *Maker) Assertion(ifaceName string) (Assertion, error) {
+	if m.AssertImport == "" {
+		return Assertion{}, fmt.Errorf("no import path of the package of %s to assert that it implements %s", m.StructName, ifaceName)
+	}
+	if m.ifaceTypeParams != "" {
+		// The type parameters may use the imports of the interface file.
+		return Assertion{}, fmt.Errorf("cannot separate the assertion that the generic %s implements %s", m.StructName, ifaceName)
+	}
+	return Assertion{
+		Import:  m.AssertImport,
+		Package: m.assertPackage(),
+		Struct:  m.StructName,
+		Iface:   ifaceName,
+	}, nil
+}
+
+// MakeAssertions returns the code of a file of the package pkgName with the
+// assertions, which are written once each. Packages of the same name are
+// imported with distinct aliases.
+func MakeAssertions(pkgName string, assertions []Assertion) ([]byte, error) {
+	if !token.IsIdentifier(pkgName) || pkgName == "_" {
+		return nil, fmt.Errorf("invalid package name %q: it must be a Go identifier other than _", pkgName)
+	}
+	aliases := make(map[string]string)
+	taken := map[string]bool{pkgName: true}
+	var pkgImports []string
+	qualifier := func(importPath, name string) string {
+		if alias, ok := aliases[importPath]; ok {
+			return alias
+		}
+		alias := name
+		for n := 2; taken[alias]; n++ {
+			alias = fmt.Sprintf("%s%d", name, n)
+		}
+		aliases[importPath] = alias
+		taken[alias] = true
+		i := importedPkg{Path: importPath}
+		if alias != path.Base(importPath) {
+			i.Alias = alias
+		}
+		pkgImports = append(pkgImports, i.Lines()...)
+		return alias
+	}
+	var vars []string
+	seen := make(map[Assertion]bool)
+	for _, a := range assertions {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		iface := a.Iface
+		if a.IfaceImport != "" {
+			iface = qualifier(a.IfaceImport, a.IfacePackage) + "." + a.Iface
+		}
+		vars = append(vars, fmt.Sprintf("_ %s = (*%s.%s)(nil)", iface, qualifier(a.Import, a.Package), a.Struct))
+	}
+	output := []string{"// Code generated by ifacemaker. DO NOT EDIT.", "", "package " + pkgName, "import ("}
+	output = append(output, pkgImports...)
+	output = append(output, ")", "var (")
+	output = append(output, vars...)
+	output = append(output, ")")
+	unformatted := strings.Join(output, "\n")
+	b, err := formatCode(unformatted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to format the assertions:\n%v\nError", unformatted)
+	}
+	return b, nil
+}
+
+// stdImport returns the name qualifying the standard library package pkg in
+// the generated code. It is imported under an alias if one of the copied
+// imports may have the same name, e.g. github.com/pkg/errors, and the import
+// is returned then.
+func (m *Maker) stdImport(pkg string) (string, *importedPkg) {
+	taken := make(map[string]bool)
+	for _, i := range m.imports {
+		if i.Path == pkg && i.Alias != "_" && i.Alias != "." {
+			if i.Alias != "" {
+				return i.Alias, nil
+			}
+			return pkg, nil
+		}
+		taken[importName(i)] = true
+	}
+	if !taken[pkg] {
+		// Added by formatCode.
+		return pkg, nil
+	}
+	alias := "std" + pkg
+	for n := 2; taken[alias]; n++ {
+		alias = fmt.Sprintf("std%s%d", pkg, n)
+	}
+	return alias, &importedPkg{Alias: alias, Path: pkg}
+}
+
+// importName returns the name of the import i, which is assumed to be the
+// last element of its path without a major version suffix.
+func importName(i *importedPkg) string {
+	if i.Alias != "" {
+		return i.Alias
+	}
+	name := path.Base(i.Path)
+	if majorVersion.MatchString(name) && path.Dir(i.Path) != "." {
+		name = path.Base(path.Dir(i.Path))
+	}
+	return name
+}
+
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
 func (m *Maker) OmitGeneratedComment() {
 	m.omitGeneratedComment = true
 }
 
-func (m *Maker) parseDeclarations(astFile *ast.File) (hasMethods bool, err error) {
-	for _, d := range astFile.Decls {
+// Warnings returns the problems found while generating the interface that
+// did not prevent the generation, e.g. ignored duplicate methods.
+func (m *Maker) Warnings() []string {
+	return m.warnings
+}
 
-		var a string
-		var fd *ast.FuncDecl
+// Stats counts the files and methods the interface was generated from.
+type Stats struct {
+	// FilesParsed are the files whose declarations were parsed.
+	FilesParsed int
+	// FilesSkipped are the files not mentioning the struct, of which only
+	// the package clause was parsed.
+	FilesSkipped int
+	// FilesExcluded are the files excluded from the target build
+	// configuration with SkipExcludedFiles.
+	FilesExcluded int
+	// FilesFailed are the files skipped with ContinueOnError.
+	FilesFailed int
+	// Methods are the methods of the interface.
+	Methods int
+	// SkippedMethods counts the methods left out of the interface by reason.
+	SkippedMethods map[SkipReason]int
+}
 
-		if a, fd = m.getReceiverTypeName(d); a != m.StructName {
-			continue
+// FilesScanned returns the number of files read.
+func (s Stats) FilesScanned() int {
+	return s.FilesParsed + s.FilesSkipped + s.FilesExcluded + s.FilesFailed
+}
+
+// SkipReason is the reason a method is left out of the interface.
+type SkipReason string
+
+const (
+	// SkippedUnexported counts the unexported methods of the struct.
+	SkippedUnexported SkipReason = "unexported"
+	// SkippedDuplicate counts the declarations of methods declared more than
+	// once dropped by the DuplicatePolicy.
+	SkippedDuplicate SkipReason = "duplicate"
+	// SkippedAmbiguous counts the methods promoted from more than one
+	// embedded field.
+	SkippedAmbiguous SkipReason = "ambiguous"
+	// SkippedFiltered counts the methods selected by ExcludeMethods.
+	SkippedFiltered SkipReason = "filtered"
+	// SkippedUnexportedType counts the methods referring to unexported types
+	// declared in the parsed files, which implementations in other packages
+	// cannot declare.
+	SkippedUnexportedType SkipReason = "unexported types"
+)
+
+// SkipReasons are all of the reasons methods are left out of the interface
+// for, in the order they are reported.
+var SkipReasons = []SkipReason{SkippedUnexported, SkippedFiltered, SkippedDuplicate, SkippedAmbiguous, SkippedUnexportedType}
+
+// Stats returns the counts of the files and methods the interface was
+// generated from. MakeInterface must be called first.
+func (m *Maker) Stats() Stats {
+	return m.stats
+}
+
+func (m *Maker) skipMethod(reason SkipReason) {
+	if m.stats.SkippedMethods == nil {
+		m.stats.SkippedMethods = make(map[SkipReason]int)
+	}
+	m.stats.SkippedMethods[reason]++
+}
+
+func (m *Maker) warnf(format string, args ...interface{}) {
+	w := fmt.Sprintf(format, args...)
+	for _, existing := range m.warnings {
+		if existing == w {
+			return
 		}
+	}
+	m.warnings = append(m.warnings, w)
+}
 
-		if !fd.Name.IsExported() {
-			continue
+// collectDeclarations records the names of all package-level declarations in
+// astFile, so that identifiers in method signatures can later be resolved
+// against the whole package rather than guessed from their capitalization.
+func (m *Maker) collectDeclarations(astFile *ast.File) {
+	for _, d := range astFile.Decls {
+		m.current = d
+		switch decl := d.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				m.declarations[decl.Name.Name] = struct{}{}
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					m.declarations[s.Name.Name] = struct{}{}
+					m.typeExprs[s.Name.Name] = s.Type
+					if s.Assign.IsValid() {
+						m.aliases[s.Name.Name] = true
+					}
+					if s.Name.Name == m.StructName && s.TypeParams != nil {
+						m.typeParams = s.TypeParams
+						m.typeParamsScope = newSignatureScope(hasDotImports(astFile), fieldNames(s.TypeParams), nil)
+					}
+					if st, ok := s.Type.(*ast.StructType); ok && m.Promote {
+						for _, field := range st.Fields.List {
+							if len(field.Names) == 0 {
+								m.embedded[s.Name.Name] = append(m.embedded[s.Name.Name], field.Type)
+								m.fields[s.Name.Name] = append(m.fields[s.Name.Name], embeddedFieldName(field.Type))
+							}
+							for _, name := range field.Names {
+								m.fields[s.Name.Name] = append(m.fields[s.Name.Name], name.Name)
+							}
+						}
+					}
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						m.declarations[name.Name] = struct{}{}
+					}
+				}
+			}
 		}
+	}
+}
 
-		hasMethods = true
-		methodName := fd.Name.String()
-		if _, ok := m.methodNames[methodName]; ok {
+// collectTypeDoc records the doc comment of the struct if astFile declares
+// it.
+func (m *Maker) collectTypeDoc(src []byte, astFile *ast.File) {
+	for _, d := range astFile.Decls {
+		decl, ok := d.(*ast.GenDecl)
+		if !ok || decl.Tok != token.TYPE {
 			continue
 		}
+		for _, spec := range decl.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != m.StructName {
+				continue
+			}
+			doc := ts.Doc
+			if doc == nil && len(decl.Specs) == 1 {
+				doc = decl.Doc
+			}
+			if doc != nil {
+				m.typeDoc = m.docLines(src, doc)
+			}
+		}
+	}
+}
 
-		method := &method{Docs: []string{}}
+// typeDecl is a type declaration kept for MakeTypes.
+type typeDecl struct {
+	spec *ast.TypeSpec
+	doc  []string
+	file *ast.File
+}
 
-		params, err := m.printParameters(fd.Type.Params)
-		if err != nil {
-			return hasMethods, errors.Wrap(err, "failed printing parameters")
+// valueDecl is a constant or variable declaration kept for MakeTypes, which
+// copies it whole, as the constants of a group may depend on each other
+// through iota.
+type valueDecl struct {
+	decl *ast.GenDecl
+	doc  []string
+	file *ast.File
+}
+
+// collectTypeDecls records the type, constant and variable declarations of
+// astFile.
+func (m *Maker) collectTypeDecls(src []byte, astFile *ast.File) {
+	if m.typeDecls == nil {
+		m.typeDecls = make(map[string]*typeDecl)
+		m.valueDecls = make(map[string]*valueDecl)
+		m.typedConsts = make(map[string][]*valueDecl)
+	}
+	for _, d := range astFile.Decls {
+		decl, ok := d.(*ast.GenDecl)
+		if ok && (decl.Tok == token.CONST || decl.Tok == token.VAR) {
+			m.collectValueDecl(src, astFile, decl)
+			continue
 		}
-		ret, err := m.printParameters(fd.Type.Results)
-		if err != nil {
-			return hasMethods, errors.Wrap(err, "failed printing return values")
+		if !ok || decl.Tok != token.TYPE {
+			continue
 		}
-		method.Code = fmt.Sprintf("%s(%s) (%s)", methodName, params, ret)
-
-		if fd.Doc != nil && m.CopyDocs {
-			for _, d := range fd.Doc.List {
-				method.Docs = append(method.Docs, d.Text)
+		for _, spec := range decl.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(decl.Specs) == 1 {
+				doc = decl.Doc
+			}
+			td := &typeDecl{spec: ts, file: astFile}
+			if doc != nil {
+				td.doc = m.docLines(src, doc)
 			}
+			m.typeDecls[ts.Name.Name] = td
 		}
-
-		m.methodNames[methodName] = struct{}{}
-		m.methods = append(m.methods, method)
 	}
-	return
 }
 
-func (m *Maker) parseImports(a *ast.File) error {
-	for _, i := range a.Imports {
-		alias := ""
-		if i.Name != nil {
-			alias = i.Name.String()
+// collectValueDecl records the constant or variable declaration decl of
+// astFile.
+func (m *Maker) collectValueDecl(src []byte, astFile *ast.File, decl *ast.GenDecl) {
+	vd := &valueDecl{decl: decl, file: astFile}
+	if decl.Doc != nil {
+		vd.doc = m.docLines(src, decl.Doc)
+	}
+	types := make(map[string]bool)
+	for _, spec := range decl.Specs {
+		vs := spec.(*ast.ValueSpec)
+		for _, name := range vs.Names {
+			m.valueDecls[name.Name] = vd
 		}
-		if alias == "." {
-			// Ignore dot imports.
-			// Without parsing all the imported packages, we can't figure out
-			// which ones are used by the interface, and which ones are not.
-			// Goimports can't do this either.
-			// However, we can't throw an error just because we find a
-			// dot import when we're parsing all the files in a directory.
-			// Let's assume that the struct we're building an
-			// interface from doesn't use types from the dot import,
-			// and everything will be fine.
+		if decl.Tok != token.CONST {
 			continue
 		}
-		path, err := strconv.Unquote(i.Path.Value)
-		if err != nil {
-			return errors.Wrapf(err, "parsing import `%v` failed", i.Path.Value)
+		// The type of a constant, as declared or converted to, e.g.
+		// ModeA Mode = iota or ModeB = Mode(1).
+		if t, ok := vs.Type.(*ast.Ident); ok {
+			types[t.Name] = true
 		}
-		if existing, ok := m.importsByPath[path]; ok && existing.Alias != alias {
-			// It would be possible to pick one alias and rewrite all the types,
-			// but that would require parsing all the imports to find the correct
-			// package name (which might differ from the import path's last element),
-			// and that would require correctly finding the package in GOPATH
-			// or vendor directories.
-			format := "package %q imported multiple times with different aliases: %v, %v"
-			return fmt.Errorf(format, path, errorAlias(existing.Alias), errorAlias(alias))
-		} else if !ok {
-			if alias != "" {
-				if _, ok := m.importsByAlias[alias]; ok {
-					return fmt.Errorf("import alias %v already in use", alias)
+		for _, v := range vs.Values {
+			if call, ok := v.(*ast.CallExpr); ok && len(call.Args) == 1 {
+				if t, ok := call.Fun.(*ast.Ident); ok {
+					types[t.Name] = true
 				}
 			}
-			imp := &importedPkg{
-				Path:  path,
-				Alias: alias,
-			}
-			m.importsByPath[path] = imp
-			m.importsByAlias[alias] = imp
-			m.imports = append(m.imports, imp)
 		}
 	}
-	return nil
+	for t := range types {
+		m.typedConsts[t] = append(m.typedConsts[t], vd)
+	}
 }
 
-// ParseSource parses the source code in src.
-// filename is used for position information only.
-func (m *Maker) ParseDeclarations(src []byte, filename string) (declarations map[string]int32, err error) {
-	m.init()
+// commentLines returns text as line comments.
+func commentLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		lines = append(lines, strings.TrimRight("// "+line, " "))
+	}
+	return lines
+}
 
-	declarations = make(map[string]int32)
-	a, err := parser.ParseFile(m.fset, filename, src, parser.ParseComments)
-	if err != nil {
-		return declarations, errors.Wrap(err, "parsing file failed")
+// hasDotImports reports whether astFile contains a dot import.
+func hasDotImports(astFile *ast.File) bool {
+	for _, i := range astFile.Imports {
+		if i.Name != nil && i.Name.Name == "." {
+			return true
+		}
 	}
-	for _, d := range a.Decls {
-		a, _ := m.getReceiverTypeName(d)
-		declarations[a]++
+	return false
+}
+
+func (m *Maker) parseDeclarations(src []byte, astFile *ast.File, matchesBuild bool) (hasMethods bool, err error) {
+	file := &sourceFile{
+		imports:    astFile.Imports,
+		dotImports: hasDotImports(astFile),
+		constraint: fileConstraint(m.fset.Position(astFile.Package).Filename, src),
+	}
+	if m.ParamComments {
+		file.comments = astFile.Comments
+	}
+	for _, d := range astFile.Decls {
+		m.current = d
+
+		var a string
+		var fd *ast.FuncDecl
+
+		if a, fd = m.getReceiverTypeName(d); fd == nil || (a != m.StructName && !m.Promote) {
+			continue
+		}
+
+		if !fd.Name.IsExported() {
+			if a == m.StructName {
+				m.skipMethod(SkippedUnexported)
+			}
+			continue
+		}
+
+		methodName := fd.Name.String()
+
+		method := &method{
+			Name:           methodName,
+			Docs:           []string{},
+			receiver:       a,
+			funcType:       fd.Type,
+			file:           file,
+			recvTypeParams: receiverTypeParams(fd),
+			recvName:       receiverName(fd),
+			pointerRecv:    isPointerReceiver(fd),
+			position:       m.fset.Position(fd.Pos()),
+			matchesBuild:   matchesBuild,
+		}
+
+		if fd.Doc != nil && m.CopyDocs {
+			method.Docs = m.docLines(src, fd.Doc)
+		}
+		if len(method.Docs) == 0 {
+			method.Docs = m.methodDocs(a, methodName)
+		}
+		if fd.Doc != nil {
+			method.annotations = annotations(fd.Doc)
+		}
+
+		if a != m.StructName {
+			// The methods of other types are only needed for promotion, and
+			// their imports are parsed once they are known to be promoted.
+			if m.Promote {
+				m.addTypeMethod(method)
+			}
+			continue
+		}
+
+		hasMethods = true
+		if existing, ok := m.methodNames[methodName]; ok {
+			existing.duplicates = append(existing.duplicates, method)
+			continue
+		}
+
+		m.methodNames[methodName] = method
+		m.methods = append(m.methods, method)
+	}
+	return
+}
+
+// methodDocs returns the lines of the doc comment in MethodDocs of the method
+// name of the type recv.
+func (m *Maker) methodDocs(recv, name string) []string {
+	doc, ok := m.MethodDocs[recv+"."+name]
+	if !ok {
+		doc = m.MethodDocs[name]
+	}
+	doc = strings.TrimRight(doc, "\n")
+	if doc == "" {
+		return []string{}
+	}
+	return commentLines(doc)
+}
+
+const annotationPrefix = "//ifacemaker:"
+
+// annotations returns the names of the //ifacemaker: directives in doc,
+// e.g. cache for //ifacemaker:cache.
+func annotations(doc *ast.CommentGroup) []string {
+	var names []string
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, annotationPrefix) {
+			if fields := strings.Fields(c.Text[len(annotationPrefix):]); len(fields) > 0 {
+				names = append(names, fields[0])
+			}
+		}
+	}
+	return names
+}
+
+// hasAnnotation reports whether the method is annotated with
+// //ifacemaker:name.
+func (m *method) hasAnnotation(name string) bool {
+	for _, a := range m.annotations {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// docLines returns the comments of the doc comment group doc as written in
+// src, one entry per line. Comments sharing a line keep the text between
+// them. Directives such as //go:generate and //nolint are left out, as they
+// do not apply to the interface method.
+func (m *Maker) docLines(src []byte, doc *ast.CommentGroup) []string {
+	var lines []string
+	prevLine, prevEnd := 0, 0
+	stripped := false
+	for _, c := range doc.List {
+		start := m.fset.Position(c.Pos())
+		text, ok := stripDirectives(c.Text)
+		if !ok {
+			stripped = true
+		} else if len(lines) > 0 && start.Line == prevLine && prevEnd <= start.Offset && start.Offset <= len(src) {
+			lines[len(lines)-1] += string(src[prevEnd:start.Offset]) + text
+		} else {
+			lines = append(lines, text)
+		}
+		end := m.fset.Position(c.End())
+		prevLine, prevEnd = end.Line, end.Offset
+	}
+	// Directives are conventionally separated from the docs by an empty line.
+	for stripped && len(lines) > 0 && lines[len(lines)-1] == "//" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+var (
+	directiveComment = regexp.MustCompile(`^//(line |extern |export |[a-z0-9]+:[a-z0-9])`)
+	nolintComment    = regexp.MustCompile(`^//\s*nolint(:\S*)?\s*`)
+	nolintSuffix     = regexp.MustCompile(`\s*//\s*nolint(:\S*)?\s*$`)
+)
+
+// stripDirectives removes the machine readable parts of the comment text,
+// keeping the explanation of a //nolint directive, e.g. "// reason" for
+// "//nolint:errcheck // reason". It returns false if nothing is left.
+func stripDirectives(text string) (string, bool) {
+	if !strings.HasPrefix(text, "//") {
+		return text, true
+	}
+	if loc := nolintComment.FindStringIndex(text); loc != nil {
+		text = text[loc[1]:]
+		return text, strings.HasPrefix(text, "//")
+	}
+	if directiveComment.MatchString(text) {
+		return "", false
+	}
+	return nolintSuffix.ReplaceAllString(text, ""), true
+}
+
+// addTypeMethod records a method of a type other than the struct, which may
+// be promoted to the struct by embedding.
+func (m *Maker) addTypeMethod(method *method) {
+	for _, existing := range m.typeMethods[method.receiver] {
+		if existing.Name == method.Name {
+			existing.duplicates = append(existing.duplicates, method)
+			return
+		}
+	}
+	m.typeMethods[method.receiver] = append(m.typeMethods[method.receiver], method)
+}
+
+// embeddedFieldName returns the name of the field of the embedded type e,
+// e.g. Mutex for *sync.Mutex.
+func embeddedFieldName(e ast.Expr) string {
+	if st, ok := e.(*ast.StarExpr); ok {
+		e = st.X
+	}
+	switch t := e.(type) {
+	case *ast.IndexExpr:
+		e = t.X
+	case *ast.IndexListExpr:
+		e = t.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	}
+	return ""
+}
+
+// embeddedTypeName returns the name of the type of an embedded field if it
+// is declared in the source package, e.g. Base for *Base.
+func embeddedTypeName(e ast.Expr) (string, bool) {
+	if st, ok := e.(*ast.StarExpr); ok {
+		e = st.X
+	}
+	ident, ok := e.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	return ident.Name, true
+}
+
+// methodSet returns the methods of the generated interface, following Go's
+// promotion rules: a method or field at a shallower depth of embedding
+// shadows those of the same name at deeper ones, and methods promoted from
+// several embedded fields at the same depth are ambiguous and excluded, as
+// they are not part of the struct's method set.
+//
+// The methods promoted from an embedded field whose type has an interface in
+// EmbeddedInterfaces are mirrored by embedding that interface, if none of
+// them is shadowed by or ambiguous with another field or the struct.
+func (m *Maker) methodSet() ([]*method, error) {
+	m.ifaceEmbeds, m.mirrored = nil, nil
+	if err := m.resolveDuplicates(m.methods); err != nil {
+		return nil, err
+	}
+	if !m.Promote {
+		return m.methods, nil
+	}
+
+	// An embedding is reached through the field of the struct at index root,
+	// or -1 for the struct itself. claimed holds the root of each name in the
+	// method set, and broken the roots whose methods are not all promoted.
+	type embedding struct {
+		expr   ast.Expr
+		parent string
+		root   int
+	}
+	shadowed := make(map[string]bool)
+	claimed := make(map[string]int)
+	for name := range m.methodNames {
+		shadowed[name] = true
+		claimed[name] = -1
+	}
+	for _, name := range m.fields[m.StructName] {
+		shadowed[name] = true
+		claimed[name] = -1
+	}
+	broken := make(map[int]bool)
+	roots := make(map[*method]int)
+	seen := map[string]int{m.StructName: -1}
+	var level []embedding
+	for i, e := range m.embedded[m.StructName] {
+		level = append(level, embedding{e, m.StructName, i})
+	}
+
+	methods := append([]*method(nil), m.methods...)
+	for len(level) > 0 {
+		// A type embedded more than once at the same depth is counted once
+		// per embedding, making its methods ambiguous.
+		var types []string
+		count := make(map[string][]int)
+		for _, e := range level {
+			name, ok := embeddedTypeName(e.expr)
+			if ok {
+				_, ok = m.declarations[name]
+			}
+			if !ok {
+				m.warnf("methods promoted from embedded field %s of %s are not included: it is not declared in the parsed files",
+					m.printExpr(e.expr), e.parent)
+				continue
+			}
+			if root, ok := seen[name]; ok {
+				if root != e.root {
+					broken[e.root] = true
+				}
+				continue
+			}
+			if len(count[name]) == 0 {
+				types = append(types, name)
+			}
+			count[name] = append(count[name], e.root)
+		}
+
+		var names []string
+		promoted := make(map[string][]*method)
+		promotedRoots := make(map[string][]int)
+		fields := make(map[string][]int)
+		add := func(name string) {
+			if _, ok := promoted[name]; !ok && len(fields[name]) == 0 {
+				names = append(names, name)
+			}
+		}
+		var next []embedding
+		for _, name := range types {
+			seen[name] = count[name][0]
+			if err := m.resolveDuplicates(m.typeMethods[name]); err != nil {
+				return nil, err
+			}
+			for _, root := range count[name] {
+				for _, method := range m.typeMethods[name] {
+					if !shadowed[method.Name] {
+						add(method.Name)
+						promoted[method.Name] = append(promoted[method.Name], method)
+						promotedRoots[method.Name] = append(promotedRoots[method.Name], root)
+					} else if claimed[method.Name] != root {
+						broken[root] = true
+					}
+				}
+				for _, field := range m.fields[name] {
+					if !shadowed[field] {
+						add(field)
+						fields[field] = append(fields[field], root)
+					}
+				}
+				for _, e := range m.embedded[name] {
+					next = append(next, embedding{e, name, root})
+				}
+			}
+		}
+
+		for _, name := range names {
+			shadowed[name] = true
+			candidates := promoted[name]
+			nameRoots := append(promotedRoots[name], fields[name]...)
+			claimed[name] = nameRoots[0]
+			for _, root := range nameRoots[1:] {
+				if root != nameRoots[0] {
+					for _, root := range nameRoots {
+						broken[root] = true
+					}
+					break
+				}
+			}
+			if len(candidates) == 0 {
+				continue
+			}
+			if len(candidates)+len(fields[name]) > 1 {
+				var receivers []string
+				for _, method := range candidates {
+					receivers = append(receivers, method.receiver)
+				}
+				m.warnf("method %s is promoted from more than one embedded field of %s (%s) and is excluded as ambiguous",
+					name, m.StructName, strings.Join(receivers, ", "))
+				m.skipMethod(SkippedAmbiguous)
+				continue
+			}
+			if err := m.parseImports(candidates[0].file.imports); err != nil {
+				return nil, err
+			}
+			methods = append(methods, candidates[0])
+			roots[candidates[0]] = nameRoots[0]
+		}
+		level = next
+	}
+
+	for root, e := range m.embedded[m.StructName] {
+		name, _ := embeddedTypeName(e)
+		iface, ok := m.EmbeddedInterfaces[name]
+		if !ok {
+			continue
+		}
+		if broken[root] {
+			m.warnf("the methods promoted from embedded field %s of %s are listed instead of embedding %s, as some of them are shadowed or ambiguous",
+				m.printExpr(e), m.StructName, iface)
+			continue
+		}
+		m.ifaceEmbeds = append(m.ifaceEmbeds, iface)
+		if m.mirrored == nil {
+			m.mirrored = make(map[*method]bool)
+		}
+		for _, method := range methods {
+			if r, ok := roots[method]; ok && r == root {
+				m.mirrored[method] = true
+			}
+		}
+	}
+	return methods, nil
+}
+
+// printExpr prints e for messages.
+func (m *Maker) printExpr(e ast.Expr) string {
+	buff := &bytes.Buffer{}
+	printer.Fprint(buff, m.fset, e)
+	return buff.String()
+}
+
+func (m *Maker) parseImports(imports []*ast.ImportSpec) error {
+	for _, i := range imports {
+		alias := ""
+		if i.Name != nil {
+			alias = i.Name.String()
+		}
+		if alias == "." {
+			// Ignore dot imports.
+			// Without parsing all the imported packages, we can't figure out
+			// which ones are used by the interface, and which ones are not.
+			// Goimports can't do this either.
+			// However, we can't throw an error just because we find a
+			// dot import when we're parsing all the files in a directory.
+			// Let's assume that the struct we're building an
+			// interface from doesn't use types from the dot import,
+			// and everything will be fine.
+			continue
+		}
+		path, err := strconv.Unquote(i.Path.Value)
+		if err != nil {
+			return errors.Wrapf(err, "parsing import `%v` failed", i.Path.Value)
+		}
+		if existing, ok := m.importsByPath[path]; ok && existing.Alias != alias {
+			// It would be possible to pick one alias and rewrite all the types,
+			// but that would require parsing all the imports to find the correct
+			// package name (which might differ from the import path's last element),
+			// and that would require correctly finding the package in GOPATH
+			// or vendor directories.
+			format := "package %q imported multiple times with different aliases: %v, %v"
+			return fmt.Errorf(format, path, errorAlias(existing.Alias), errorAlias(alias))
+		} else if !ok {
+			if alias != "" {
+				if _, ok := m.importsByAlias[alias]; ok {
+					return fmt.Errorf("import alias %v already in use", alias)
+				}
+			}
+			imp := &importedPkg{
+				Path:  path,
+				Alias: alias,
+			}
+			m.importsByPath[path] = imp
+			m.importsByAlias[alias] = imp
+			m.imports = append(m.imports, imp)
+		}
+	}
+	return nil
+}
+
+// ParseSource parses the source code in src.
+// filename is used for position information only.
+func (m *Maker) ParseDeclarations(src []byte, filename string) (declarations map[string]int32, err error) {
+	m.init()
+
+	declarations = make(map[string]int32)
+	src = bytes.TrimPrefix(src, utf8BOM)
+	if err := checkEncoding(filename, src); err != nil {
+		return declarations, err
+	}
+	// Only the receivers are needed, so the file is not added to the
+	// FileSet, which would keep growing with every file listed.
+	a, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.SkipObjectResolution)
+	if err != nil {
+		return declarations, newParseError(filename, err)
+	}
+	for _, d := range a.Decls {
+		a, _ := m.getReceiverTypeName(d)
+		declarations[a]++
+	}
+	return
+}
+
+// ParseMarkedTypes returns the types declared in src that are marked for
+// generating an interface: annotated with //ifacemaker:generate or, if
+// marker is not empty, embedding a field of the type marker as written in
+// src, e.g. ifacegen.Marker. filename is used for position information only.
+func (m *Maker) ParseMarkedTypes(src []byte, filename, marker string) ([]string, error) {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	if err := checkEncoding(filename, src); err != nil {
+		return nil, err
+	}
+	a, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.SkipObjectResolution|parser.ParseComments)
+	if err != nil {
+		return nil, newParseError(filename, err)
+	}
+	var names []string
+	for _, d := range a.Decls {
+		decl, ok := d.(*ast.GenDecl)
+		if !ok || decl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range decl.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(decl.Specs) == 1 {
+				doc = decl.Doc
+			}
+			if isMarked(ts, doc, marker) {
+				names = append(names, ts.Name.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// isMarked reports whether the type ts with the doc comment doc is marked
+// for generating an interface, see ParseMarkedTypes.
+func isMarked(ts *ast.TypeSpec, doc *ast.CommentGroup, marker string) bool {
+	if doc != nil {
+		for _, a := range annotations(doc) {
+			if a == "generate" {
+				return true
+			}
+		}
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok || marker == "" {
+		return false
+	}
+	for _, field := range st.Fields.List {
+		if len(field.Names) > 0 {
+			continue
+		}
+		t := field.Type
+		if star, ok := t.(*ast.StarExpr); ok {
+			t = star.X
+		}
+		switch t := t.(type) {
+		case *ast.Ident:
+			if t.Name == marker {
+				return true
+			}
+		case *ast.SelectorExpr:
+			if x, ok := t.X.(*ast.Ident); ok && x.Name+"."+t.Sel.Name == marker {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseMode returns the parser mode for the source files. Comments are
+// only parsed if they are copied or may hold annotations for decorators, as
+// heavily commented files, e.g. generated code, parse considerably faster
+// without them.
+func (m *Maker) parseMode() parser.Mode {
+	mode := parser.SkipObjectResolution
+	if m.CopyDocs || m.CopyTypeDoc || m.CopyTypes || m.ParamComments || len(m.Decorators) > 0 {
+		mode |= parser.ParseComments
+	}
+	return mode
+}
+
+// ParseSource parses the source code in src.
+// filename is used for position information only.
+func (m *Maker) ParseSource(src []byte, filename string) (err error) {
+	m.init()
+	m.current = nil
+	defer m.recoverPanic(&err, filename)
+
+	src, a, err := m.parse(src, filename)
+	if err != nil {
+		return err
+	}
+	return m.addFile(src, a, filename)
+}
+
+// parse parses the source code in src, returning it without a byte order
+// mark. It may be called concurrently.
+func (m *Maker) parse(src []byte, filename string) ([]byte, *ast.File, error) {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	if err := checkEncoding(filename, src); err != nil {
+		return nil, nil, err
+	}
+	a, err := parser.ParseFile(m.fset, filename, src, m.parseMode())
+	if err != nil {
+		return nil, nil, newParseError(filename, err)
+	}
+	return src, a, nil
+}
+
+// ParseCache holds the files read and parsed by the makers sharing it with
+// their Cache field. A file is released once all of them are done with it,
+// so that a cache does not hold the files for longer than needed. It is safe
+// for concurrent use.
+type ParseCache struct {
+	fset  *token.FileSet
+	users int
+	mu    sync.Mutex
+	files map[cacheKey]*cachedFile
+}
+
+// NewParseCache returns a ParseCache for the number of makers users.
+func NewParseCache(users int) *ParseCache {
+	return &ParseCache{fset: token.NewFileSet(), users: users, files: make(map[cacheKey]*cachedFile)}
+}
+
+// cacheKey identifies a file of a ParseCache, which is parsed again for
+// another parser mode.
+type cacheKey struct {
+	filename string
+	mode     parser.Mode
+}
+
+// cachedFile is a file of a ParseCache, with the results of reading and
+// parsing it.
+type cachedFile struct {
+	read sync.Once
+	src  []byte
+	err  error
+
+	parsed     sync.Once
+	parsedSrc  []byte
+	file       *ast.File
+	parseErr   error
+	doneMakers int
+}
+
+// file returns the file filename parsed in mode, added if needed.
+func (c *ParseCache) file(filename string, mode parser.Mode) *cachedFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{filename, mode}
+	f := c.files[key]
+	if f == nil {
+		f = &cachedFile{}
+		c.files[key] = f
+	}
+	return f
+}
+
+// release records that a maker is done with the file filename parsed in
+// mode, releasing it once all the makers are.
+func (c *ParseCache) release(filename string, mode parser.Mode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{filename, mode}
+	if f := c.files[key]; f != nil {
+		f.doneMakers++
+		if f.doneMakers >= c.users {
+			delete(c.files, key)
+		}
+	}
+}
+
+// readFile reads the file filename, once for the makers sharing the Cache.
+func (m *Maker) readFile(filename string) ([]byte, error) {
+	if m.Cache == nil {
+		return ioutil.ReadFile(filename)
+	}
+	f := m.Cache.file(filename, m.parseMode())
+	f.read.Do(func() {
+		f.src, f.err = ioutil.ReadFile(filename)
+	})
+	return f.src, f.err
+}
+
+// parseFile is parse for the file filename with the source src, once for
+// the makers sharing the Cache.
+func (m *Maker) parseFile(src []byte, filename string) ([]byte, *ast.File, error) {
+	if m.Cache == nil {
+		return m.parse(src, filename)
+	}
+	f := m.Cache.file(filename, m.parseMode())
+	f.parsed.Do(func() {
+		// A panic is kept as the error of the file, for all the makers.
+		defer func() {
+			if p := recover(); p != nil {
+				f.parseErr = panicError(filename, p)
+			}
+		}()
+		f.parsedSrc, f.file, f.parseErr = m.parse(src, filename)
+	})
+	return f.parsedSrc, f.file, f.parseErr
+}
+
+// releaseFile tells the Cache that the maker is done with the file filename.
+func (m *Maker) releaseFile(filename string) {
+	if m.Cache != nil {
+		m.Cache.release(filename, m.parseMode())
+	}
+}
+
+// addFile adds the declarations of the parsed file a with the source src.
+func (m *Maker) addFile(src []byte, a *ast.File, filename string) (err error) {
+	matchesBuild := false
+	if m.DuplicatePolicy == DuplicateBuild || m.SkipExcludedFiles {
+		matchesBuild = m.matchesBuild(filename, src)
+	}
+	if m.SkipExcludedFiles && !matchesBuild {
+		m.stats.FilesExcluded++
+		return nil
+	}
+	defer func() {
+		if err == nil {
+			m.stats.FilesParsed++
+		}
+	}()
+	if m.sourceLineEndings == "" {
+		m.sourceLineEndings = DetectLineEndings(src)
+	}
+	m.addPackageFile(a.Name.Name, filename)
+	if err := m.checkGoVersion(a); err != nil {
+		return err
+	}
+	m.collectDeclarations(a)
+	if m.CopyTypeDoc {
+		m.collectTypeDoc(src, a)
+	}
+	if m.CopyTypes {
+		m.collectTypeDecls(src, a)
+	}
+	hasMethods, err := m.parseDeclarations(src, a, matchesBuild)
+	if err != nil {
+		return err
+	}
+
+	// No point checking imports if there are no relevant methods in this file.
+	// This also avoids throwing unnecessary errors about imports in files that
+	// are not relevant.
+	if !hasMethods {
+		return nil
+	}
+	if hasDotImports(a) {
+		m.dotImports = true
+	}
+
+	err = m.parseImports(a.Imports)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// matchesBuild reports whether the file would be included in a build for the
+// target build configuration, based on its name and build constraints.
+func (m *Maker) matchesBuild(filename string, src []byte) bool {
+	ctx := m.buildContext()
+	ctx.BuildTags = m.BuildTags
+	ctx.OpenFile = func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(src)), nil
+	}
+	dir, name := filepath.Split(filename)
+	archs := []string{ctx.GOARCH}
+	if m.GOOS != "" && m.GOARCH == "" {
+		archs = osArchs(m.GOOS)
+	}
+	for _, arch := range archs {
+		ctx.GOARCH = arch
+		if match, err := ctx.MatchFile(dir, name); err != nil || !match {
+			return false
+		}
+	}
+	return true
+}
+
+// ports are the architectures each operating system is ported to, as listed
+// by go tool dist list.
+var ports = map[string][]string{
+	"aix":       {"ppc64"},
+	"android":   {"386", "amd64", "arm", "arm64"},
+	"darwin":    {"amd64", "arm64"},
+	"dragonfly": {"amd64"},
+	"freebsd":   {"386", "amd64", "arm", "arm64"},
+	"illumos":   {"amd64"},
+	"ios":       {"amd64", "arm64"},
+	"js":        {"wasm"},
+	"linux": {"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le", "mipsle",
+		"ppc64", "ppc64le", "riscv64", "s390x"},
+	"netbsd":  {"386", "amd64", "arm", "arm64"},
+	"openbsd": {"386", "amd64", "arm", "arm64", "ppc64", "riscv64"},
+	"plan9":   {"386", "amd64", "arm"},
+	"solaris": {"amd64"},
+	"wasip1":  {"wasm"},
+	"windows": {"386", "amd64", "arm64"},
+}
+
+// osArchs returns the architectures of the operating system goos, all known
+// architectures if it has no port.
+func osArchs(goos string) []string {
+	if archs, ok := ports[goos]; ok {
+		return archs
+	}
+	var archs []string
+	for arch := range knownArch {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// buildConfig returns the name of the target build configuration, e.g.
+// linux/amd64, or linux for all of its architectures.
+func (m *Maker) buildConfig() string {
+	ctx := m.buildContext()
+	if m.GOOS != "" && m.GOARCH == "" {
+		return ctx.GOOS
+	}
+	return ctx.GOOS + "/" + ctx.GOARCH
+}
+
+// fileConstraint returns the expression of the build constraints of the Go
+// source src in filename, or "" if it has none: those implied by a _GOOS or
+// _GOARCH suffix of the name, and those in the header. Legacy // +build lines
+// are only used without a //go:build line, as by the go command.
+func fileConstraint(filename string, src []byte) string {
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
+	for len(src) > 0 {
+		line := src
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, src = line[:i], src[i+1:]
+		} else {
+			src = nil
+		}
+		text := string(bytes.TrimSpace(line))
+		if text == "" {
+			continue
+		}
+		if !strings.HasPrefix(text, "//") {
+			break
+		}
+		if !constraint.IsGoBuild(text) && !constraint.IsPlusBuild(text) {
+			continue
+		}
+		expr, err := constraint.Parse(text)
+		if err != nil {
+			continue
+		}
+		if constraint.IsGoBuild(text) {
+			if goBuild == nil {
+				goBuild = expr
+			}
+		} else {
+			plusBuild = append(plusBuild, expr)
+		}
+	}
+	expr := goBuild
+	if expr == nil && len(plusBuild) > 0 {
+		expr = plusBuild[0]
+		for _, x := range plusBuild[1:] {
+			expr = &constraint.AndExpr{X: expr, Y: x}
+		}
+	}
+	if name := nameConstraint(filename); name != nil {
+		if expr == nil || expr.String() == name.String() {
+			expr = name
+		} else {
+			expr = &constraint.AndExpr{X: name, Y: expr}
+		}
+	}
+	if expr == nil {
+		return ""
+	}
+	return expr.String()
+}
+
+// knownOS and knownArch are the values of GOOS and GOARCH the go command
+// recognizes in file names, as listed by go/build.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+		"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+		"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+		"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true,
+		"mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true,
+		"sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+// nameConstraint returns the build constraint implied by a _GOOS, _GOARCH or
+// _GOOS_GOARCH suffix of the file name, optionally followed by _test, or nil
+// if it has none. As for the go command, the part of the name before the
+// first underscore is not a suffix, so linux.go is not constrained.
+func nameConstraint(filename string) constraint.Expr {
+	name := strings.SplitN(filepath.Base(filename), ".", 2)[0]
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return nil
+	}
+	l := strings.Split(name[i:], "_")
+	if n := len(l); l[n-1] == "test" {
+		l = l[:n-1]
+	}
+	n := len(l)
+	if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+		return &constraint.AndExpr{X: &constraint.TagExpr{Tag: l[n-2]}, Y: &constraint.TagExpr{Tag: l[n-1]}}
+	}
+	if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return &constraint.TagExpr{Tag: l[n-1]}
+	}
+	return nil
+}
+
+// buildConstraint returns the expression of the //go:build line of the
+// generated file, BuildConstraint or the constraint shared by the files
+// declaring methods if CopyBuildConstraint is true.
+func (m *Maker) buildConstraint(methods []*method) string {
+	if m.BuildConstraint != "" || !m.CopyBuildConstraint || len(methods) == 0 {
+		return m.BuildConstraint
+	}
+	shared := methods[0].file.constraint
+	for _, method := range methods[1:] {
+		if method.file.constraint != shared {
+			var constraints []string
+			seen := make(map[string]bool)
+			for _, method := range methods {
+				c := method.file.constraint
+				if c == "" {
+					c = "none"
+				}
+				if !seen[c] {
+					seen[c] = true
+					constraints = append(constraints, c)
+				}
+			}
+			m.warnf("the build constraints of the files declaring the methods differ (%s) and are not copied",
+				strings.Join(constraints, "; "))
+			return ""
+		}
+	}
+	return shared
+}
+
+// buildContext returns the context of the target build configuration.
+func (m *Maker) buildContext() build.Context {
+	ctx := build.Default
+	if m.GOOS != "" {
+		ctx.GOOS = m.GOOS
+	}
+	if m.GOARCH != "" {
+		ctx.GOARCH = m.GOARCH
+	}
+	return ctx
+}
+
+// resolveDuplicates applies the DuplicatePolicy to all methods declared in
+// more than one file, replacing them with the declaration to use.
+func (m *Maker) resolveDuplicates(methods []*method) error {
+	for i, method := range methods {
+		if len(method.duplicates) == 0 {
+			continue
+		}
+		chosen, err := m.resolveDuplicate(method)
+		if err != nil {
+			return err
+		}
+		for range method.duplicates {
+			m.skipMethod(SkippedDuplicate)
+		}
+		methods[i] = chosen
+	}
+	return nil
+}
+
+func (m *Maker) resolveDuplicate(first *method) (*method, error) {
+	all := append([]*method{first}, first.duplicates...)
+	switch m.DuplicatePolicy {
+	case "", DuplicateFirst:
+		for _, dropped := range first.duplicates {
+			m.warnf("method %s declared at %v is ignored, the declaration at %v is used instead",
+				first.Name, dropped.position, first.position)
+		}
+		return first, nil
+	case DuplicateError:
+		return nil, fmt.Errorf("method %s is declared more than once: %s",
+			first.Name, methodPositions(all))
+	case DuplicateBuild:
+		var matching []*method
+		for _, method := range all {
+			if method.matchesBuild {
+				matching = append(matching, method)
+			}
+		}
+		if len(matching) != 1 {
+			return nil, fmt.Errorf("method %s: %d of the declarations %s match the target build configuration %s, expected exactly one",
+				first.Name, len(matching), methodPositions(all), m.buildConfig())
+		}
+		return matching[0], nil
+	case DuplicateIdentical:
+		for _, method := range all {
+			if err := m.renderMethod(method); err != nil {
+				return nil, errors.Wrapf(err, "method %s", method.Name)
+			}
+			if method.Code != first.Code {
+				return nil, fmt.Errorf("method %s has different signatures: %q at %v and %q at %v",
+					first.Name, first.Code, first.position, method.Code, method.position)
+			}
+		}
+		return first, nil
+	}
+	return nil, fmt.Errorf("unknown duplicate policy %q", m.DuplicatePolicy)
+}
+
+// methodPositions formats the source positions of methods for error messages.
+func methodPositions(methods []*method) string {
+	var positions []string
+	for _, method := range methods {
+		positions = append(positions, method.position.String())
+	}
+	return strings.Join(positions, ", ")
+}
+
+// renderMethod prints the signature of method into method.Code.
+// Rendering is deferred until all sources have been parsed, so that
+// identifiers are qualified based on the declarations of the whole package.
+func (m *Maker) renderMethod(method *method) (err error) {
+	m.current = method.funcType
+	defer m.recoverPanic(&err, method.position.Filename)
+	var typeParams []string
+	if method.receiver == m.StructName {
+		typeParams = fieldNames(m.typeParams)
+	}
+	if len(method.recvTypeParams) != len(typeParams) {
+		return fmt.Errorf("receiver has %d type parameters, but the declaration of %s has %d",
+			len(method.recvTypeParams), method.receiver, len(typeParams))
+	}
+	scope := newSignatureScope(method.file.dotImports, method.recvTypeParams, typeParams)
+	method.scope = scope
+	var comments, resultComments []*ast.CommentGroup
+	if m.ParamComments {
+		comments = method.file.comments
+		if !isSingleUnnamed(method.funcType.Results) {
+			resultComments = comments
+		}
+	}
+	params, err := m.printParameters(method.funcType.Params, scope, comments)
+	if err != nil {
+		return errors.Wrap(err, "failed printing parameters")
+	}
+	results := method.funcType.Results
+	if m.NoResultNames {
+		results = unnamedResults(results)
+		resultComments = nil
+	}
+	ret, err := m.printParameters(results, scope, resultComments)
+	if err != nil {
+		return errors.Wrap(err, "failed printing return values")
+	}
+	method.Code = fmt.Sprintf("%s(%s)%s", method.Name, params, formatResults(results, ret))
+	return nil
+}
+
+// unnamedResults returns results without the result names, repeating the
+// type of grouped results, e.g. (int, int) for (a, b int).
+func unnamedResults(results *ast.FieldList) *ast.FieldList {
+	if results == nil {
+		return nil
+	}
+	unnamed := &ast.FieldList{Opening: results.Opening, Closing: results.Closing}
+	for _, field := range results.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			unnamed.List = append(unnamed.List, &ast.Field{Type: field.Type})
+		}
+	}
+	return unnamed
+}
+
+// formatResults formats the printed result list ret of a signature.
+// Like gofmt, it omits the parentheses if there are no results or a single
+// unnamed result.
+func formatResults(results *ast.FieldList, ret string) string {
+	switch {
+	case results.NumFields() == 0:
+		return ""
+	case isSingleUnnamed(results):
+		return " " + ret
+	}
+	return " (" + ret + ")"
+}
+
+// isSingleUnnamed reports whether results is a single unnamed result.
+func isSingleUnnamed(results *ast.FieldList) bool {
+	return results != nil && len(results.List) == 1 && len(results.List[0].Names) == 0
+}
+
+// addPackageFile records that filename declares the package pkgName.
+// External test packages are treated as part of the package they test.
+func (m *Maker) addPackageFile(pkgName, filename string) {
+	pkgName = strings.TrimSuffix(pkgName, "_test")
+	if _, ok := m.packageFiles[pkgName]; !ok {
+		m.packageNames = append(m.packageNames, pkgName)
+	}
+	m.packageFiles[pkgName] = append(m.packageFiles[pkgName], filename)
+}
+
+// checkPackages fails if the parsed files belong to different packages, as
+// their declarations and imports cannot be merged into one interface.
+func (m *Maker) checkPackages() error {
+	if len(m.packageNames) < 2 {
+		return nil
+	}
+	var pkgs []string
+	for _, pkgName := range m.packageNames {
+		pkgs = append(pkgs, fmt.Sprintf("package %s (%s)", pkgName, strings.Join(m.packageFiles[pkgName], ", ")))
+	}
+	return fmt.Errorf("the source files belong to different packages: %s; "+
+		"list only the files of the package declaring %s instead of their directory",
+		strings.Join(pkgs, ", "), m.StructName)
+}
+
+// validateNames checks that the names of the generated package and interface
+// are valid, and that the interface name does not hide a package used by the
+// method signatures.
+func (m *Maker) validateNames(pkgName, ifaceName string, methods []*method) error {
+	if !token.IsIdentifier(pkgName) || pkgName == "_" {
+		if strings.Contains(pkgName, "/") {
+			return fmt.Errorf("invalid package name %q: use the package name instead of the import path, e.g. %q",
+				pkgName, path.Base(pkgName))
+		}
+		return fmt.Errorf("invalid package name %q: it must be a Go identifier other than _", pkgName)
+	}
+	if !token.IsIdentifier(ifaceName) || ifaceName == "_" {
+		return fmt.Errorf("invalid interface name %q: it must be a Go identifier other than _, e.g. %q",
+			ifaceName, m.StructName+"Iface")
+	}
+	if ifaceName == m.srcPackage {
+		return fmt.Errorf("interface name %q collides with the package name used by --rewrite", ifaceName)
+	}
+	if m.AssertImport != "" && m.srcPackage == "" && m.assertPackage() == "main" {
+		return fmt.Errorf("cannot assert that %s implements %s: package main cannot be imported", m.StructName, ifaceName)
+	}
+	if m.AssertImport != "" && ifaceName == m.assertPackage() {
+		return fmt.Errorf("interface name %q collides with the name of the source package %s", ifaceName, m.AssertImport)
+	}
+	for _, method := range methods {
+		var collision bool
+		ast.Inspect(method.funcType, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Name == ifaceName {
+					collision = true
+				}
+			}
+			return !collision
+		})
+		if collision {
+			return fmt.Errorf("interface name %q collides with the imported package %s used by method %s at %v",
+				ifaceName, ifaceName, method.Name, method.position)
+		}
+	}
+	return nil
+}
+
+func (m *Maker) makeInterface(pkgName, ifaceName string) (string, error) {
+	if err := m.checkPackages(); err != nil {
+		return "", err
+	}
+	methods, err := m.methodSet()
+	if err != nil {
+		return "", err
+	}
+	methods = m.filterMethods(methods)
+	if err := m.validateNames(pkgName, ifaceName, methods); err != nil {
+		return "", err
+	}
+	m.ifaceMethods = methods
+	m.stats.Methods = len(methods)
+	for _, method := range methods {
+		if err := m.renderMethod(method); err != nil {
+			return "", errors.Wrapf(err, "method %s", method.Name)
+		}
+	}
+	typeParams, err := m.printParameters(m.typeParams, m.typeParamsScope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing type parameters")
+	}
+	if typeParams != "" {
+		if m.targetsBefore(genericsVersion) {
+			return "", fmt.Errorf("%s has type parameters, which require %s, but the target Go version is %s",
+				m.StructName, genericsVersion, m.targetGoVersion())
+		}
+		typeParams = "[" + typeParams + "]"
+	}
+	m.ifaceTypeParams = typeParams
+
+	var output []string
+	if c := m.buildConstraint(methods); c != "" {
+		expr, err := constraint.Parse("//go:build " + c)
+		if err != nil {
+			return "", fmt.Errorf("invalid build constraint %q: %v", c, err)
+		}
+		output = append(output, "//go:build "+expr.String())
+		if m.targetsBefore(goBuildVersion) {
+			lines, err := constraint.PlusBuildLines(expr)
+			if err != nil {
+				return "", fmt.Errorf("build constraint %q: %v", c, err)
+			}
+			output = append(output, lines...)
+		}
+		output = append(output, "")
+	}
+	if !m.omitGeneratedComment {
+		output = append(output, "// Code generated by ifacemaker. DO NOT EDIT.")
+	}
+	if m.Invocation != "" {
+		if strings.ContainsAny(m.Invocation, "\r\n") {
+			return "", fmt.Errorf("invalid invocation %q: it must be a single line", m.Invocation)
+		}
+		output = append(output, invocationPrefix+m.Invocation)
+	}
+	if m.Comment != "" {
+		output = append(output, commentLines(m.Comment)...)
+	}
+	output = append(output, "")
+	output = append(output, "package "+pkgName)
+	output = append(output, "import (")
+	for _, pkgImport := range m.imports {
+		output = append(output, pkgImport.Lines()...)
+	}
+	var errorsImport *importedPkg
+	m.errorsName, errorsImport = m.stdImport("errors")
+	if errorsImport != nil {
+		// Removed by formatCode unless used by Unimplemented or Multiplexer.
+		output = append(output, errorsImport.Lines()...)
+	}
+	if imp := m.assertImport(); imp != nil && !m.SeparateAssertion {
+		output = append(output, imp.Lines()...)
+	}
+	output = append(output, ")")
+	if m.SeparateAssertion {
+		// Written by MakeAssertions.
+	} else if srcPackage := m.assertPackage(); srcPackage != "" && typeParams != "" {
+		// A generic struct can only be checked against the interface
+		// from within a generic function declaring the same type parameters.
+		typeArgs := "[" + strings.Join(fieldNames(m.typeParams), ", ") + "]"
+		output = append(output,
+			fmt.Sprintf("func _%s() {", typeParams),
+			fmt.Sprintf("var _ %s%s = (*%s.%s%s)(nil)", ifaceName, typeArgs, srcPackage, m.StructName, typeArgs),
+			"}",
+		)
+	} else if srcPackage != "" {
+		output = append(output,
+			fmt.Sprintf("var _ %s = (*%s.%s)(nil)", ifaceName, srcPackage, m.StructName),
+		)
+	}
+	var doc []string
+	if m.IfaceComment != "" {
+		doc = commentLines(m.IfaceComment)
+	}
+	if len(doc) > 0 && len(m.typeDoc) > 0 {
+		doc = append(doc, "//")
+	}
+	doc = append(doc, m.typeDoc...)
+	output = append(output, doc...)
+	output = append(output,
+		fmt.Sprintf("type %s%s interface {", ifaceName, typeParams),
+	)
+	output = append(output, m.ifaceEmbeds...)
+	for _, method := range methods {
+		if !m.mirrored[method] {
+			output = append(output, method.Lines()...)
+		}
+	}
+	output = append(output, "}")
+
+	typeArgs := ""
+	if typeParams != "" {
+		typeArgs = "[" + strings.Join(fieldNames(m.typeParams), ", ") + "]"
+	}
+	switch m.Unimplemented {
+	case "":
+	case UnimplementedError, UnimplementedPanic:
+		unimplemented := "Unimplemented" + ifaceName
+		output = append(output,
+			"",
+			fmt.Sprintf("// %s can be embedded in implementations of %s, so that they keep", unimplemented, ifaceName),
+			"// compiling when methods are added to the interface.",
+			fmt.Sprintf("type %s%s struct{}", unimplemented, typeParams),
+		)
+		for _, method := range methods {
+			stub, err := m.renderStub(method, ifaceName, unimplemented+typeArgs)
+			if err != nil {
+				return "", errors.Wrapf(err, "method %s", method.Name)
+			}
+			output = append(output, "", stub)
+		}
+	default:
+		return "", fmt.Errorf("unknown unimplemented mode %q, use error or panic", m.Unimplemented)
+	}
+
+	for _, d := range m.Decorators {
+		var decorator []string
+		switch d {
+		case DecoratorCache:
+			decorator, err = m.renderCache(ifaceName, typeParams, typeArgs, methods)
+		case DecoratorLocked:
+			decorator, err = m.renderLocked(ifaceName, typeParams, typeArgs, methods)
+		default:
+			err = fmt.Errorf("unknown decorator %q, use cache or locked", d)
+		}
+		if err != nil {
+			return "", err
+		}
+		output = append(output, decorator...)
+	}
+
+	if m.Multiplexer {
+		multiplexer := ifaceName + "Multiplexer"
+		errorsDoc := "// The errors are joined, and the other results are those of the last implementation."
+		if m.targetsBefore(joinVersion) {
+			// errors.Join is not available.
+			errorsDoc = "// The first error is returned, and the other results are those of the last implementation."
+		}
+		output = append(output,
+			"",
+			fmt.Sprintf("// %s forwards the calls of %s to all of its implementations in order.", multiplexer, ifaceName),
+			errorsDoc,
+			fmt.Sprintf("type %s%s []%s%s", multiplexer, typeParams, ifaceName, typeArgs),
+		)
+		for _, method := range methods {
+			forward, err := m.renderForward(method, multiplexer+typeArgs)
+			if err != nil {
+				return "", errors.Wrapf(err, "method %s", method.Name)
+			}
+			output = append(output, "", forward)
+		}
+	}
+
+	return strings.Join(output, "\n"), nil
+}
+
+// renderStub renders the method of the Unimplemented struct recv.
+func (m *Maker) renderStub(method *method, ifaceName, recv string) (string, error) {
+	params, err := m.printParameters(method.funcType.Params, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing parameters")
+	}
+	results := method.funcType.Results
+	if m.NoResultNames {
+		results = unnamedResults(results)
+	}
+	message := fmt.Sprintf("%q", ifaceName+"."+method.Name+" is not implemented")
+	body := "panic(" + message + ")"
+	if m.Unimplemented == UnimplementedError && returnsError(results) {
+		var errName string
+		results, errName = namedResults(newFieldNamer(method.funcType.Params, results), results)
+		body = errName + " = " + m.errorsName + ".New(" + message + ")\nreturn"
+	}
+	ret, err := m.printParameters(results, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing return values")
+	}
+	return fmt.Sprintf("func (%s) %s(%s)%s {\n%s\n}", recv, method.Name, params, formatResults(results, ret), body), nil
+}
+
+// renderCache renders the cache decorator of the interface, which caches
+// the results of the methods selected by CacheMethods or annotated with
+// //ifacemaker:cache, and forwards the other calls.
+func (m *Maker) renderCache(ifaceName, typeParams, typeArgs string, methods []*method) ([]string, error) {
+	cache := ifaceName + "Cache"
+	entry := strings.ToLower(cache[:1]) + cache[1:] + "Entry"
+	var cached []*method
+	for _, method := range methods {
+		if !method.hasAnnotation("cache") && (m.CacheMethods == nil || !m.CacheMethods.MatchString(method.Name)) {
+			continue
+		}
+		if reason := m.uncacheable(method.funcType); reason != "" {
+			m.warnf("method %s is not cached: %s", method.Name, reason)
+			continue
+		}
+		cached = append(cached, method)
+	}
+	if len(cached) == 0 {
+		m.warnf("%s caches no methods: annotate them with //ifacemaker:cache or select them by name", cache)
+	}
+
+	var names []string
+	for _, method := range cached {
+		names = append(names, method.Name)
+	}
+	recv := "*" + cache + typeArgs
+	output := []string{
+		"",
+		fmt.Sprintf("// %s caches the results of %s of the wrapped %s.", cache, strings.Join(names, ", "), ifaceName),
+		"// The results are kept for TTL, or forever if it is zero, unless the call fails.",
+		"// The other methods are forwarded. It is safe for concurrent use.",
+		fmt.Sprintf("type %s%s struct {", cache, typeParams),
+		ifaceName + typeArgs,
+		"TTL time.Duration",
+		"",
+		"mu sync.Mutex",
+		"entries map[string]map[interface{}]" + entry,
+		"}",
+		"",
+		fmt.Sprintf("type %s struct {", entry),
+		"results []interface{}",
+		"expires time.Time",
+		"}",
+		"",
+		fmt.Sprintf("func (c %s) load(method string, key interface{}) ([]interface{}, bool) {", recv),
+		"c.mu.Lock()",
+		"defer c.mu.Unlock()",
+		"e, ok := c.entries[method][key]",
+		"if !ok || !e.expires.IsZero() && time.Now().After(e.expires) {",
+		"return nil, false",
+		"}",
+		"return e.results, true",
+		"}",
+		"",
+		fmt.Sprintf("func (c %s) store(method string, key interface{}, results ...interface{}) {", recv),
+		"c.mu.Lock()",
+		"defer c.mu.Unlock()",
+		"if c.entries == nil {",
+		"c.entries = make(map[string]map[interface{}]" + entry + ")",
+		"}",
+		"if c.entries[method] == nil {",
+		"c.entries[method] = make(map[interface{}]" + entry + ")",
+		"}",
+		"e := " + entry + "{results: results}",
+		"if c.TTL > 0 {",
+		"e.expires = time.Now().Add(c.TTL)",
+		"}",
+		"c.entries[method][key] = e",
+		"}",
+	}
+	for _, method := range cached {
+		code, err := m.renderCached(method, ifaceName, recv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "method %s", method.Name)
+		}
+		output = append(output, "", code)
+	}
+	return output, nil
+}
+
+// uncacheable returns why the results of a method with the signature ft
+// cannot be cached, or an empty string if they can.
+func (m *Maker) uncacheable(ft *ast.FuncType) string {
+	if ft.Results.NumFields() == 0 {
+		return "it has no results"
+	}
+	for _, field := range ft.Params.List {
+		if _, ok := field.Type.(*ast.Ellipsis); ok {
+			return "it is variadic"
+		}
+		if !isContext(field.Type) && !m.hashable(field.Type, make(map[string]bool)) {
+			return "its parameters cannot be compared"
+		}
+	}
+	return ""
+}
+
+// comparableTypes are the predeclared types whose values can be map keys.
+var comparableTypes = map[string]bool{
+	"bool": true, "string": true, "byte": true, "rune": true, "uintptr": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true, "complex64": true, "complex128": true,
+}
+
+// hashable reports whether the values of the type expr can be keys of a map
+// without panicking, resolving the types declared in the parsed files. The
+// values of interfaces may not be, and the types of other packages are assumed
+// to be. seen are the declared types being resolved.
+func (m *Maker) hashable(expr ast.Expr, seen map[string]bool) bool {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if typeExpr, ok := m.typeExprs[t.Name]; ok {
+			if seen[t.Name] {
+				return true
+			}
+			seen[t.Name] = true
+			return m.hashable(typeExpr, seen)
+		}
+		if m.typeParams != nil {
+			for _, field := range m.typeParams.List {
+				for _, name := range field.Names {
+					if name.Name == t.Name {
+						// Only a comparable type argument is known to be.
+						constraint, ok := field.Type.(*ast.Ident)
+						return ok && constraint.Name == "comparable"
+					}
+				}
+			}
+		}
+		return comparableTypes[t.Name]
+	case *ast.ParenExpr:
+		return m.hashable(t.X, seen)
+	case *ast.IndexExpr:
+		return m.hashable(t.X, seen)
+	case *ast.IndexListExpr:
+		return m.hashable(t.X, seen)
+	case *ast.StarExpr, *ast.ChanType, *ast.SelectorExpr:
+		return true
+	case *ast.ArrayType:
+		return t.Len != nil && m.hashable(t.Elt, seen)
+	case *ast.StructType:
+		for _, field := range t.Fields.List {
+			if !m.hashable(field.Type, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	// Maps, functions and interfaces.
+	return false
+}
+
+// renderCached renders the method of the cache decorator recv, which loads
+// the results from the cache or calls the wrapped implementation, embedded
+// as the field iface.
+func (m *Maker) renderCached(method *method, iface, recv string) (string, error) {
+	n := newFieldNamer(method.funcType.Params, method.funcType.Results)
+	params := n.nameFields(method.funcType.Params, "p", func(int) string { return "p0" })
+	results, _ := namedResults(n, method.funcType.Results)
+	c, key, r := n.name("c", "c"), n.name("key", "key"), n.name("r", "r")
+
+	args := fieldNames(params)
+	// A context differs between calls that should share the cached results.
+	var keys []string
+	for _, field := range params.List {
+		for _, name := range field.Names {
+			if !isContext(field.Type) {
+				keys = append(keys, name.Name)
+			}
+		}
+	}
+	names := fieldNames(results)
+	stored := names
+	if returnsError(results) {
+		stored = names[:len(names)-1]
+	}
+
+	body := []string{
+		fmt.Sprintf("%s := [%d]interface{}{%s}", key, len(keys), strings.Join(keys, ", ")),
+		fmt.Sprintf("if %s, ok := %s.load(%q, %s); ok {", r, c, method.Name, key),
+	}
+	for i, name := range stored {
+		t, err := m.printParameters(&ast.FieldList{List: []*ast.Field{{Type: resultType(results, i)}}}, method.scope, nil)
+		if err != nil {
+			return "", errors.Wrap(err, "failed printing return values")
+		}
+		body = append(body, fmt.Sprintf("%s, _ = %s[%d].(%s)", name, r, i, t))
+	}
+	body = append(body,
+		"return",
+		"}",
+		fmt.Sprintf("%s = %s.%s.%s(%s)", strings.Join(names, ", "), c, iface, method.Name, strings.Join(args, ", ")),
+	)
+	store := fmt.Sprintf("%s.store(%q, %s, %s)", c, method.Name, key, strings.Join(stored, ", "))
+	if len(stored) < len(names) {
+		body = append(body, "if "+names[len(names)-1]+" == nil {", store, "}")
+	} else {
+		body = append(body, store)
+	}
+	body = append(body, "return")
+
+	printedParams, err := m.printParameters(params, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing parameters")
+	}
+	ret, err := m.printParameters(results, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing return values")
+	}
+	return fmt.Sprintf("func (%s %s) %s(%s)%s {\n%s\n}",
+		c, recv, method.Name, printedParams, formatResults(results, ret), strings.Join(body, "\n")), nil
+}
+
+// isContext reports whether t is context.Context.
+func isContext(t ast.Expr) bool {
+	sel, ok := t.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == "context" && sel.Sel.Name == "Context"
+}
+
+// resultType returns the type of the result i of results.
+func resultType(results *ast.FieldList, i int) ast.Expr {
+	for _, field := range results.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		if i < n {
+			return field.Type
+		}
+		i -= n
+	}
+	return nil
+}
+
+// renderLocked renders the locked decorator of the interface, which holds a
+// mutex during the calls of the wrapped implementation. The methods selected
+// by ReadOnlyMethods or annotated with //ifacemaker:readonly only hold a read
+// lock, if there are any.
+func (m *Maker) renderLocked(ifaceName, typeParams, typeArgs string, methods []*method) ([]string, error) {
+	locked := ifaceName + "Locked"
+	var readOnly []string
+	isReadOnly := make(map[*method]bool)
+	for _, method := range methods {
+		if method.hasAnnotation("readonly") || m.ReadOnlyMethods != nil && m.ReadOnlyMethods.MatchString(method.Name) {
+			readOnly = append(readOnly, method.Name)
+			isReadOnly[method] = true
+		}
+	}
+
+	output := []string{
+		"",
+		fmt.Sprintf("// %s serializes the calls of the wrapped %s, so that it is safe for", locked, ifaceName),
+		"// concurrent use.",
+	}
+	mutex := "sync.Mutex"
+	if len(readOnly) > 0 {
+		mutex = "sync.RWMutex"
+		output = append(output, fmt.Sprintf("// The read-only methods %s may run concurrently.", strings.Join(readOnly, ", ")))
+	}
+	output = append(output,
+		fmt.Sprintf("type %s%s struct {", locked, typeParams),
+		ifaceName+typeArgs,
+		"",
+		"mu "+mutex,
+		"}",
+	)
+	for _, method := range methods {
+		code, err := m.renderLockedMethod(method, ifaceName, "*"+locked+typeArgs, isReadOnly[method])
+		if err != nil {
+			return nil, errors.Wrapf(err, "method %s", method.Name)
+		}
+		output = append(output, "", code)
+	}
+	return output, nil
+}
+
+// renderLockedMethod renders the method of the locked decorator recv, which
+// calls the wrapped implementation, embedded as the field iface, holding
+// the mutex or, if readOnly is true, a read lock.
+func (m *Maker) renderLockedMethod(method *method, iface, recv string, readOnly bool) (string, error) {
+	n := newFieldNamer(method.funcType.Params, method.funcType.Results)
+	params := n.nameFields(method.funcType.Params, "p", func(int) string { return "p0" })
+	l := n.name("l", "l")
+
+	lock, unlock := "Lock", "Unlock"
+	if readOnly {
+		lock, unlock = "RLock", "RUnlock"
+	}
+	call := fmt.Sprintf("%s.%s.%s(%s)", l, iface, method.Name, strings.Join(callArgs(params), ", "))
+	if method.funcType.Results.NumFields() > 0 {
+		call = "return " + call
+	}
+	body := []string{
+		fmt.Sprintf("%s.mu.%s()", l, lock),
+		fmt.Sprintf("defer %s.mu.%s()", l, unlock),
+		call,
+	}
+
+	printedParams, err := m.printParameters(params, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing parameters")
+	}
+	results := method.funcType.Results
+	if m.NoResultNames {
+		results = unnamedResults(results)
+	}
+	ret, err := m.printParameters(results, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing return values")
+	}
+	return fmt.Sprintf("func (%s %s) %s(%s)%s {\n%s\n}",
+		l, recv, method.Name, printedParams, formatResults(results, ret), strings.Join(body, "\n")), nil
+}
+
+// callArgs returns the arguments passing the parameters params on to a
+// call, with the variadic one spread.
+func callArgs(params *ast.FieldList) []string {
+	args := fieldNames(params)
+	if len(params.List) > 0 {
+		if _, ok := params.List[len(params.List)-1].Type.(*ast.Ellipsis); ok {
+			args[len(args)-1] += "..."
+		}
+	}
+	return args
+}
+
+// renderForward renders the method of the multiplexer type recv, which
+// calls the method of every implementation.
+func (m *Maker) renderForward(method *method, recv string) (string, error) {
+	n := newFieldNamer(method.funcType.Params, method.funcType.Results)
+	params := n.nameFields(method.funcType.Params, "p", func(int) string { return "p0" })
+	results := method.funcType.Results
+	hasError := returnsError(results)
+	if results.NumFields() > 0 {
+		results, _ = namedResults(n, results)
+	}
+	mux, impl := n.name("mux", "mux"), n.name("impl", "impl")
+
+	call := fmt.Sprintf("%s.%s(%s)", impl, method.Name, strings.Join(callArgs(params), ", "))
+	loop := fmt.Sprintf("for _, %s := range %s {", impl, mux)
+
+	var body []string
+	names := fieldNames(results)
+	switch {
+	case hasError && m.targetsBefore(joinVersion):
+		e, err := n.name("e", "e"), names[len(names)-1]
+		body = append(body, loop)
+		if len(names) == 1 {
+			body = append(body, fmt.Sprintf("if %s := %s; %s != nil && %s == nil {", e, call, e, err))
+		} else {
+			targets := append(names[:len(names)-1:len(names)-1], e)
+			body = append(body,
+				"var "+e+" error",
+				strings.Join(targets, ", ")+" = "+call,
+				"if "+e+" != nil && "+err+" == nil {",
+			)
+		}
+		body = append(body, err+" = "+e, "}", "}", "return")
+	case hasError:
+		errs, e := n.name("errs", "errs"), n.name("e", "e")
+		body = append(body, "var "+errs+" []error", loop)
+		if len(names) == 1 {
+			body = append(body, fmt.Sprintf("if %s := %s; %s != nil {", e, call, e))
+		} else {
+			targets := append(names[:len(names)-1:len(names)-1], e)
+			body = append(body,
+				"var "+e+" error",
+				strings.Join(targets, ", ")+" = "+call,
+				"if "+e+" != nil {",
+			)
+		}
+		body = append(body,
+			fmt.Sprintf("%s = append(%s, %s)", errs, errs, e),
+			"}",
+			"}",
+			fmt.Sprintf("%s = %s.Join(%s...)", names[len(names)-1], m.errorsName, errs),
+			"return",
+		)
+	case len(names) > 0:
+		body = append(body, loop, strings.Join(names, ", ")+" = "+call, "}", "return")
+	default:
+		body = append(body, loop, call, "}")
+	}
+
+	printedParams, err := m.printParameters(params, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing parameters")
+	}
+	ret, err := m.printParameters(results, method.scope, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed printing return values")
+	}
+	return fmt.Sprintf("func (%s %s) %s(%s)%s {\n%s\n}",
+		mux, recv, method.Name, printedParams, formatResults(results, ret), strings.Join(body, "\n")), nil
+}
+
+// returnsError reports whether the last result of results is an error.
+func returnsError(results *ast.FieldList) bool {
+	if results.NumFields() == 0 {
+		return false
+	}
+	ident, ok := results.List[len(results.List)-1].Type.(*ast.Ident)
+	return ok && ident.Name == "error"
+}
+
+// fieldNamer hands out names for the fields of a signature that are not
+// used by the signature yet.
+type fieldNamer map[string]bool
+
+func newFieldNamer(fls ...*ast.FieldList) fieldNamer {
+	n := make(fieldNamer)
+	for _, fl := range fls {
+		for _, name := range fieldNames(fl) {
+			n[name] = true
+		}
+	}
+	return n
+}
+
+// name returns name if it is unused, or else the first unused name of
+// prefix followed by a number.
+func (n fieldNamer) name(name, prefix string) string {
+	for i := 0; n[name]; i++ {
+		name = fmt.Sprintf("%s%d", prefix, i)
+	}
+	n[name] = true
+	return name
+}
+
+// nameFields returns fl with a name for every field, replacing blank names.
+// The unnamed field i is named preferred(i) if that is unused.
+func (n fieldNamer) nameFields(fl *ast.FieldList, prefix string, preferred func(i int) string) *ast.FieldList {
+	if fl == nil {
+		return nil
+	}
+	named := &ast.FieldList{Opening: fl.Opening, Closing: fl.Closing}
+	for i, field := range fl.List {
+		var names []*ast.Ident
+		for _, name := range field.Names {
+			if name.Name == "_" {
+				name = ast.NewIdent(n.name(prefix+"0", prefix))
+			}
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			names = append(names, ast.NewIdent(n.name(preferred(i), prefix)))
+		}
+		named.List = append(named.List, &ast.Field{Names: names, Type: field.Type})
+	}
+	return named
+}
+
+// namedResults returns results with a name for every result, so that the
+// generated methods can set them and return. A last error result is named
+// err if possible. It also returns the name of the last result.
+func namedResults(n fieldNamer, results *ast.FieldList) (*ast.FieldList, string) {
+	named := n.nameFields(results, "r", func(i int) string {
+		if i == len(results.List)-1 && returnsError(results) {
+			return "err"
+		}
+		return "r0"
+	})
+	names := fieldNames(named)
+	return named, names[len(names)-1]
+}
+
+// MakeInterface creates the go file with the generated interface.
+// The package will be named pkgName, and the interface will be named ifaceName.
+func (m *Maker) MakeInterface(pkgName, ifaceName string) ([]byte, error) {
+	unformatted, err := m.makeInterface(pkgName, ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	b, err := formatCode(unformatted)
+	if err != nil {
+		err = errors.Wrapf(err, "Failed to format generated code. This could be a bug in ifacemaker. The generated code was:\n%v\nError", unformatted)
+		return b, err
+	}
+	b = m.restoreDocs(b, ifaceName)
+	m.checkAddedImports(b)
+	m.ifaceCode = b
+	return m.convertLineEndings(b)
+}
+
+// restoreDocs replaces the method docs of the interface ifaceName in the
+// formatted code b with the comments as written in the sources, since the
+// printer re-indents the lines of block comments.
+func (m *Maker) restoreDocs(b []byte, ifaceName string) []byte {
+	docs := make(map[string][]string)
+	for _, method := range m.ifaceMethods {
+		if len(method.Docs) > 0 {
+			docs[method.Name] = method.Docs
+		}
+	}
+	if len(docs) == 0 {
+		return b
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", b, parser.ParseComments)
+	if err != nil {
+		return b
+	}
+	var restored bytes.Buffer
+	last := 0
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			it, ok := ts.Type.(*ast.InterfaceType)
+			if !ok || ts.Name.Name != ifaceName {
+				continue
+			}
+			for _, field := range it.Methods.List {
+				if field.Doc == nil || len(field.Names) != 1 {
+					continue
+				}
+				lines, ok := docs[field.Names[0].Name]
+				if !ok {
+					continue
+				}
+				start := fset.Position(field.Doc.Pos()).Offset
+				end := fset.Position(field.Doc.End()).Offset
+				indent := b[bytes.LastIndexByte(b[:start], '\n')+1 : start]
+				restored.Write(b[last:start])
+				restored.WriteString(strings.Join(lines, "\n"+string(indent)))
+				last = end
+			}
+		}
+	}
+	restored.Write(b[last:])
+	return restored.Bytes()
+}
+
+// ReferencedTypes returns the names of the types declared in the parsed
+// files that the interface refers to, directly or through other such types,
+// with the constants and variables these types refer to and the constants of
+// the types, in the order of their declarations. A constant or variable
+// declaration is named by the first name it declares. CopyTypes must be set,
+// and MakeInterface must be called first.
+func (m *Maker) ReferencedTypes() []string {
+	seen := make(map[string]bool)
+	seenValues := make(map[*valueDecl]bool)
+	var queue []*typeDecl
+	var values []*valueDecl
+	addValues := func(vd *valueDecl) {
+		if !seenValues[vd] {
+			seenValues[vd] = true
+			values = append(values, vd)
+		}
+	}
+	visit := func(e ast.Node, shadowed map[string]bool) {
+		m.referencedIdents(e, shadowed, func(ident *ast.Ident) {
+			if td, ok := m.typeDecls[ident.Name]; ok && !seen[ident.Name] {
+				seen[ident.Name] = true
+				queue = append(queue, td)
+				for _, vd := range m.typedConsts[ident.Name] {
+					addValues(vd)
+				}
+			} else if vd, ok := m.valueDecls[ident.Name]; ok {
+				addValues(vd)
+			}
+		})
+	}
+	for _, method := range m.ifaceMethods {
+		shadowed := make(map[string]bool)
+		if method.scope != nil {
+			for name := range method.scope.typeParams {
+				shadowed[name] = true
+			}
+		}
+		visit(method.funcType, shadowed)
+	}
+	if m.typeParams != nil {
+		visit(m.typeParams, nil)
+	}
+	for i, j := 0, 0; i < len(queue) || j < len(values); {
+		if i < len(queue) {
+			visit(queue[i].spec, typeParamNames(queue[i].spec))
+			i++
+			continue
+		}
+		visit(values[j].decl, nil)
+		j++
+	}
+
+	type ref struct {
+		name string
+		pos  token.Pos
+	}
+	var refs []ref
+	for _, td := range queue {
+		refs = append(refs, ref{td.spec.Name.Name, td.spec.Pos()})
+	}
+	for _, vd := range values {
+		refs = append(refs, ref{vd.decl.Specs[0].(*ast.ValueSpec).Names[0].Name, vd.decl.Pos()})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].pos < refs[j].pos })
+	var names []string
+	for _, r := range refs {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// filterMethods returns methods without those selected by ExcludeMethods and
+// those referring to unexported types declared in the parsed files.
+func (m *Maker) filterMethods(methods []*method) []*method {
+	var result []*method
+	for _, method := range methods {
+		if m.ExcludeMethods != nil && m.ExcludeMethods.MatchString(method.Name) {
+			m.skipMethod(SkippedFiltered)
+			continue
+		}
+		if name := m.unexportedType(method); name != "" {
+			m.warnf("method %s is excluded, as it refers to the unexported type %s", method.Name, name)
+			m.skipMethod(SkippedUnexportedType)
+			continue
+		}
+		result = append(result, method)
+	}
+	return result
+}
+
+// unexportedType returns the name of the first unexported type declared in
+// the parsed files the signature of method refers to, or "" if there is none.
+// An unexported alias only counts if the aliased type does, as other
+// packages can refer to the aliased type instead.
+func (m *Maker) unexportedType(method *method) string {
+	shadowed := make(map[string]bool)
+	if method.scope != nil {
+		for name := range method.scope.typeParams {
+			shadowed[name] = true
+		}
+	}
+	var name string
+	seen := make(map[string]bool)
+	var visit func(e ast.Node)
+	visit = func(e ast.Node) {
+		m.referencedIdents(e, shadowed, func(ident *ast.Ident) {
+			typeExpr, ok := m.typeExprs[ident.Name]
+			switch {
+			case !ok || name != "" || ident.IsExported():
+			case m.aliases[ident.Name]:
+				if !seen[ident.Name] {
+					seen[ident.Name] = true
+					visit(typeExpr)
+				}
+			default:
+				name = ident.Name
+			}
+		})
+	}
+	visit(method.funcType)
+	return name
+}
+
+// typeParamNames returns the set of the type parameters of ts.
+func typeParamNames(ts *ast.TypeSpec) map[string]bool {
+	shadowed := make(map[string]bool)
+	if ts.TypeParams != nil {
+		for _, name := range fieldNames(ts.TypeParams) {
+			shadowed[name] = true
+		}
+	}
+	return shadowed
+}
+
+// referencedIdents calls fn with the identifiers of e that may refer to the
+// package-level declarations of the parsed files, except those in shadowed.
+func (m *Maker) referencedIdents(e ast.Node, shadowed map[string]bool, fn func(*ast.Ident)) {
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch t := n.(type) {
+		case *ast.TypeSpec:
+			// Not the name of the type.
+			if t.TypeParams != nil {
+				m.referencedIdents(t.TypeParams, shadowed, fn)
+			}
+			m.referencedIdents(t.Type, shadowed, fn)
+			return false
+		case *ast.ValueSpec:
+			// Not the names of the constants or variables.
+			if t.Type != nil {
+				m.referencedIdents(t.Type, shadowed, fn)
+			}
+			for _, v := range t.Values {
+				m.referencedIdents(v, shadowed, fn)
+			}
+			return false
+		case *ast.SelectorExpr:
+			// Unless it is a package-level declaration, X is an imported
+			// package and Sel is declared in it.
+			if x, ok := t.X.(*ast.Ident); ok {
+				if _, declared := m.declarations[x.Name]; !declared {
+					return false
+				}
+			}
+			m.referencedIdents(t.X, shadowed, fn)
+			return false
+		case *ast.Field:
+			// Only the types of fields, not their names, refer to types.
+			m.referencedIdents(t.Type, shadowed, fn)
+			return false
+		case *ast.KeyValueExpr:
+			// The keys of struct literals are the names of their fields.
+			if _, ok := t.Key.(*ast.Ident); !ok {
+				m.referencedIdents(t.Key, shadowed, fn)
+			}
+			m.referencedIdents(t.Value, shadowed, fn)
+			return false
+		case *ast.Ident:
+			if _, declared := m.declarations[t.Name]; declared && !shadowed[t.Name] {
+				fn(t)
+			}
+		}
+		return true
+	})
+}
+
+// MakeTypes returns the code of a file of the package pkgName with copies of
+// the declarations names, e.g. those returned by ReferencedTypes. The
+// declaration of a constant or variable is copied whole. The methods of the
+// types are not copied, and the copies must not refer to other declarations,
+// e.g. functions. CopyTypes must be set.
+func (m *Maker) MakeTypes(pkgName string, names []string) ([]byte, error) {
+	var decls []string
+	var imports []string
+	seenImports := make(map[string]bool)
+	addImports := func(file *ast.File, name string) error {
+		for _, i := range file.Imports {
+			var b bytes.Buffer
+			if err := printer.Fprint(&b, m.fset, i); err != nil {
+				return errors.Wrapf(err, "failed printing the imports of %s", name)
+			}
+			if !seenImports[b.String()] {
+				seenImports[b.String()] = true
+				imports = append(imports, b.String())
+			}
+		}
+		return nil
+	}
+	copied := make(map[string]bool)
+	var copiedNodes []ast.Node
+	var nodeNames []string
+	seenValues := make(map[*valueDecl]bool)
+	for _, name := range names {
+		if vd, ok := m.valueDecls[name]; ok {
+			if seenValues[vd] {
+				continue
+			}
+			seenValues[vd] = true
+			if err := addImports(vd.file, name); err != nil {
+				return nil, err
+			}
+			decl := *vd.decl
+			decl.Doc = nil
+			var b bytes.Buffer
+			b.WriteString(strings.Join(append(vd.doc, ""), "\n"))
+			if err := printer.Fprint(&b, m.fset, &printer.CommentedNode{Node: &decl, Comments: vd.file.Comments}); err != nil {
+				return nil, errors.Wrapf(err, "failed printing %s", name)
+			}
+			decls = append(decls, b.String())
+			for _, spec := range vd.decl.Specs {
+				for _, n := range spec.(*ast.ValueSpec).Names {
+					copied[n.Name] = true
+				}
+			}
+			copiedNodes = append(copiedNodes, vd.decl)
+			nodeNames = append(nodeNames, name)
+			continue
+		}
+		td, ok := m.typeDecls[name]
+		if !ok {
+			return nil, fmt.Errorf("type %s is not declared in the parsed files", name)
+		}
+		if err := addImports(td.file, name); err != nil {
+			return nil, err
+		}
+		// The doc comment is written as in the source instead.
+		spec := *td.spec
+		spec.Doc = nil
+		var b bytes.Buffer
+		b.WriteString(strings.Join(append(td.doc, "type "), "\n"))
+		if err := printer.Fprint(&b, m.fset, &printer.CommentedNode{Node: &spec, Comments: td.file.Comments}); err != nil {
+			return nil, errors.Wrapf(err, "failed printing type %s", name)
+		}
+		decls = append(decls, b.String())
+		copied[name] = true
+		copiedNodes = append(copiedNodes, td.spec)
+		nodeNames = append(nodeNames, name)
+	}
+	for i, node := range copiedNodes {
+		var shadowed map[string]bool
+		if ts, ok := node.(*ast.TypeSpec); ok {
+			shadowed = typeParamNames(ts)
+		}
+		var missing string
+		m.referencedIdents(node, shadowed, func(ident *ast.Ident) {
+			if !copied[ident.Name] && missing == "" {
+				missing = ident.Name
+			}
+		})
+		if missing == "" {
+			continue
+		}
+		_, isType := m.typeDecls[missing]
+		if _, isValue := m.valueDecls[missing]; isType || isValue {
+			return nil, fmt.Errorf("%s refers to %s, which is not copied", nodeNames[i], missing)
+		}
+		return nil, fmt.Errorf("%s refers to %s, which cannot be copied: only types, constants and variables are", nodeNames[i], missing)
+	}
+
+	output := []string{"// Code generated by ifacemaker. DO NOT EDIT.", "", "package " + pkgName}
+	if len(imports) == 1 {
+		output = append(output, "import "+imports[0])
+	} else {
+		output = append(output, "import (")
+		output = append(output, imports...)
+		output = append(output, ")")
+	}
+	for _, decl := range decls {
+		output = append(output, "", decl)
+	}
+	unformatted := strings.Join(output, "\n")
+	b, err := formatCode(unformatted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to format the copied types:\n%v\nError", unformatted)
+	}
+	return m.convertLineEndings(b)
+}
+
+// Model describes a generated interface, for tools and documentation.
+type Model struct {
+	Package   string `json:"package"`
+	Interface string `json:"interface"`
+	Struct    string `json:"struct"`
+	// TypeParams are the type parameters of the interface, e.g. [T any].
+	TypeParams string `json:"type_params,omitempty"`
+	// Doc is the text of the doc comment of the interface.
+	Doc string `json:"doc,omitempty"`
+	// Embeds are the interfaces embedded instead of listing their methods.
+	Embeds  []string      `json:"embeds,omitempty"`
+	Methods []ModelMethod `json:"methods"`
+	// Imports are the imports the signatures of the methods refer to.
+	Imports []ModelImport `json:"imports,omitempty"`
+}
+
+// ModelMethod is a method of a Model.
+type ModelMethod struct {
+	Name string `json:"name"`
+	// Signature is the method as declared in the interface, e.g.
+	// Get(key string) (string, error).
+	Signature string `json:"signature"`
+	Doc       string `json:"doc,omitempty"`
+	// Embedded is the embedded interface declaring the method, if any.
+	Embedded string `json:"embedded,omitempty"`
+	// Receiver is the type declaring the method, the struct or a type it
+	// embeds, with the name and the pointer-ness of the receiver.
+	Receiver        string `json:"receiver"`
+	ReceiverName    string `json:"receiver_name,omitempty"`
+	PointerReceiver bool   `json:"pointer_receiver,omitempty"`
+}
+
+// ModelImport is an import of a Model. Name is only set for a renamed import.
+type ModelImport struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+}
+
+// Model returns the model of the interface ifaceName of the package pkgName.
+// MakeInterface must be called first.
+func (m *Maker) Model(pkgName, ifaceName string) Model {
+	var doc []string
+	if m.IfaceComment != "" {
+		doc = commentLines(m.IfaceComment)
+	}
+	if len(doc) > 0 && len(m.typeDoc) > 0 {
+		doc = append(doc, "//")
+	}
+	doc = append(doc, m.typeDoc...)
+	model := Model{
+		Package:    pkgName,
+		Interface:  ifaceName,
+		Struct:     m.StructName,
+		TypeParams: m.ifaceTypeParams,
+		Doc:        commentText(doc),
+		Embeds:     m.ifaceEmbeds,
+		Methods:    []ModelMethod{},
+	}
+	for _, method := range m.ifaceMethods {
+		mm := ModelMethod{
+			Name:            method.Name,
+			Signature:       method.Code,
+			Doc:             commentText(method.Docs),
+			Receiver:        method.receiver,
+			ReceiverName:    method.recvName,
+			PointerReceiver: method.pointerRecv,
+		}
+		if m.mirrored[method] {
+			mm.Embedded = m.EmbeddedInterfaces[method.receiver]
+		}
+		model.Methods = append(model.Methods, mm)
+	}
+	// The imports are those kept in the formatted code, which only lists
+	// those in use.
+	if f, err := parser.ParseFile(token.NewFileSet(), "", m.ifaceCode, parser.ImportsOnly); err == nil {
+		for _, i := range f.Imports {
+			path, err := strconv.Unquote(i.Path.Value)
+			if err != nil {
+				continue
+			}
+			mi := ModelImport{Path: path}
+			if i.Name != nil {
+				mi.Name = i.Name.Name
+			}
+			model.Imports = append(model.Imports, mi)
+		}
+	}
+	return model
+}
+
+// commentText returns the text of the comment lines, without the comment
+// markers.
+func commentText(lines []string) string {
+	var text []string
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "//"):
+			line = strings.TrimPrefix(strings.TrimPrefix(line, "//"), " ")
+		case strings.HasPrefix(line, "/*"):
+			line = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "/*"), "*/"))
+		default:
+			line = strings.TrimSpace(strings.TrimSuffix(line, "*/"))
+		}
+		text = append(text, line)
+	}
+	return strings.TrimSpace(strings.Join(text, "\n"))
+}
+
+// MakeExamples returns the code of a test file of the package pkgName with
+// a skeleton Example function per method of the interface ifaceName, whose
+// body is the code block of the doc comment of the method if it has one.
+// The code blocks are type checked with the interface, and those that do not
+// compile, e.g. as they use variables of the surrounding text, are commented
+// out instead. The file has no generated comment, as it is meant to be
+// edited, and MakeInterface must be called first.
+func (m *Maker) MakeExamples(pkgName, ifaceName string) ([]byte, error) {
+	bodies := make(map[string][]string)
+	var code []*method
+	for _, method := range m.ifaceMethods {
+		if body := m.exampleBody(method, ifaceName); body != nil {
+			bodies[method.Name] = body
+			code = append(code, method)
+		}
+	}
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+	for {
+		b, err := m.renderExamples(pkgName, ifaceName, bodies)
+		if err != nil {
+			return nil, err
+		}
+		if len(code) == 0 {
+			return m.convertLineEndings(b)
+		}
+		failed, ok := m.checkExamples(fset, imp, b, ifaceName)
+		if len(failed) == 0 && ok {
+			return m.convertLineEndings(b)
+		}
+		var remaining []*method
+		for _, method := range code {
+			if failed[method.Name] || len(failed) == 0 {
+				// The file does not compile for another reason, so that
+				// none of the code blocks is kept.
+				delete(bodies, method.Name)
+			} else {
+				remaining = append(remaining, method)
+			}
+		}
+		code = remaining
+	}
+}
+
+// exampleBody returns the body of the Example function of method made from
+// the code block of its doc comment, or nil if it has none.
+func (m *Maker) exampleBody(method *method, ifaceName string) []string {
+	code, idents := docCode(method.Docs)
+	if code == "" {
+		return nil
+	}
+	var body []string
+	if idents[method.recvName] && m.typeParams == nil {
+		// The example is compiled but not run, as it has no output.
+		body = append(body, fmt.Sprintf("var %s %s", method.recvName, ifaceName))
 	}
-	return
+	return append(body, code)
 }
 
-// ParseSource parses the source code in src.
-// filename is used for position information only.
-func (m *Maker) ParseSource(src []byte, filename string) error {
-	m.init()
+// renderExamples returns the formatted code of the examples, whose bodies
+// are those of bodies by method name or a comment.
+func (m *Maker) renderExamples(pkgName, ifaceName string, bodies map[string][]string) ([]byte, error) {
+	output := []string{"package " + pkgName}
+	for _, method := range m.ifaceMethods {
+		output = append(output, "", fmt.Sprintf("func Example%s_%s() {", ifaceName, method.Name))
+		if body, ok := bodies[method.Name]; ok {
+			output = append(output, body...)
+		} else if code, _ := docCode(method.Docs); code != "" {
+			output = append(output, fmt.Sprintf("// Call %s of an implementation of %s, e.g.", method.Name, ifaceName), "//")
+			for _, line := range strings.Split(code, "\n") {
+				output = append(output, strings.TrimRight("//"+line, " "))
+			}
+		} else {
+			output = append(output, fmt.Sprintf("// Call %s of an implementation of %s.", method.Name, ifaceName))
+		}
+		output = append(output, "}")
+	}
+	unformatted := strings.Join(output, "\n")
+	b, err := formatCode(unformatted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to format the examples:\n%v\nError", unformatted)
+	}
+	return b, nil
+}
 
-	a, err := parser.ParseFile(m.fset, filename, src, parser.ParseComments)
+// checkExamples type checks the examples src with the interface generated by
+// MakeInterface. It returns the methods whose examples do not compile, and
+// whether the others do.
+func (m *Maker) checkExamples(fset *token.FileSet, imp types.Importer, src []byte, ifaceName string) (map[string]bool, bool) {
+	iface, err := parser.ParseFile(fset, "iface.go", m.ifaceCode, 0)
 	if err != nil {
-		return errors.Wrap(err, "parsing file failed")
+		return nil, false
 	}
-	hasMethods, err := m.parseDeclarations(a)
+	examples, err := parser.ParseFile(fset, "example_test.go", src, 0)
 	if err != nil {
-		return err
+		return nil, false
 	}
-
-	// No point checking imports if there are no relevant methods in this file.
-	// This also avoids throwing unnecessary errors about imports in files that
-	// are not relevant.
-	if !hasMethods {
-		return nil
+	failed := make(map[string]bool)
+	ok := true
+	conf := types.Config{
+		GoVersion: m.targetGoVersion(),
+		Importer:  imp,
+		Error: func(err error) {
+			terr, isTypeErr := err.(types.Error)
+			if !isTypeErr || fset.File(terr.Pos) != fset.File(examples.Pos()) {
+				// The errors of the interface are not those of the examples.
+				return
+			}
+			for _, decl := range examples.Decls {
+				if fd, isFunc := decl.(*ast.FuncDecl); isFunc && fd.Pos() <= terr.Pos && terr.Pos < fd.End() {
+					failed[strings.TrimPrefix(fd.Name.Name, "Example"+ifaceName+"_")] = true
+					return
+				}
+			}
+			ok = false
+		},
 	}
+	conf.Check(examples.Name.Name, fset, []*ast.File{iface, examples}, nil)
+	return failed, ok
+}
 
-	err = m.parseImports(a)
+// docCode returns the code blocks, the indented lines, of the doc comment
+// lines docs with the identifiers they use, or "" if there are none or they
+// are not Go statements.
+func docCode(docs []string) (string, map[string]bool) {
+	var lines []string
+	for _, line := range docs {
+		text := strings.TrimPrefix(line, "//")
+		if len(text) == len(line) {
+			// A block comment.
+			return "", nil
+		}
+		if strings.HasPrefix(text, "\t") || strings.HasPrefix(text, "  ") {
+			lines = append(lines, text)
+		} else if strings.TrimSpace(text) == "" && len(lines) > 0 {
+			lines = append(lines, "")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	code := strings.Join(lines, "\n")
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc _() {\n"+code+"\n}", 0)
 	if err != nil {
-		return err
+		return "", nil
 	}
+	idents := make(map[string]bool)
+	ast.Inspect(f.Decls[0], func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			idents[ident.Name] = true
+		}
+		return true
+	})
+	return code, idents
+}
 
-	return nil
+// receiverName returns the name of the receiver of the method fd, or "" if
+// it is unnamed.
+func receiverName(fd *ast.FuncDecl) string {
+	if names := fd.Recv.List[0].Names; len(names) > 0 && names[0].Name != "_" {
+		return names[0].Name
+	}
+	return ""
 }
 
-func (m *Maker) makeInterface(pkgName, ifaceName string) string {
-	var output []string
-	if !m.omitGeneratedComment {
-		output = append(output, "// Code generated by ifacemaker. DO NOT EDIT.")
+// checkAddedImports warns about imports added with AddImport that were
+// removed from the formatted code b because nothing references them.
+func (m *Maker) checkAddedImports(b []byte) {
+	if len(m.addedImports) == 0 {
+		return
 	}
-	output = append(output, "")
-	output = append(output, "package "+pkgName)
-	output = append(output, "import (")
-	for _, pkgImport := range m.imports {
-		output = append(output, pkgImport.Lines()...)
+	f, err := parser.ParseFile(token.NewFileSet(), "", b, parser.ImportsOnly)
+	if err != nil {
+		return
 	}
-	output = append(output, ")")
-	if m.srcPackage != "" {
-		output = append(output,
-			fmt.Sprintf("var _ %s = (*%s.%s)(nil)", ifaceName, m.srcPackage, m.StructName),
-		)
+	used := make(map[string]struct{})
+	for _, i := range f.Imports {
+		if path, err := strconv.Unquote(i.Path.Value); err == nil {
+			used[path] = struct{}{}
+		}
 	}
-	output = append(output,
-		fmt.Sprintf("type %s interface {", ifaceName),
-	)
-	for _, method := range m.methods {
-		output = append(output, method.Lines()...)
+	for _, i := range m.addedImports {
+		if _, ok := used[i.Path]; !ok {
+			m.warnf("added import %q is not used by the generated interface and was removed, check the import path and the rewrite package prefix", i.Path)
+		}
 	}
-	output = append(output, "}")
-
-	return strings.Join(output, "\n")
 }
 
-// MakeInterface creates the go file with the generated interface.
-// The package will be named pkgName, and the interface will be named ifaceName.
-func (m *Maker) MakeInterface(pkgName, ifaceName string) ([]byte, error) {
-	unformatted := m.makeInterface(pkgName, ifaceName)
-	b, err := formatCode(unformatted)
-	if err != nil {
-		err = errors.Wrapf(err, "Failed to format generated code. This could be a bug in ifacemaker. The generated code was:\n%v\nError", unformatted)
+// convertLineEndings converts the "\n" line endings of the formatted code b
+// to the selected LineEndings.
+func (m *Maker) convertLineEndings(b []byte) ([]byte, error) {
+	le := m.LineEndings
+	if le == AutoLineEndings {
+		le = m.sourceLineEndings
 	}
-	return b, err
+	switch le {
+	case "", LF:
+		return b, nil
+	case CRLF:
+		return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1), nil
+	}
+	return nil, fmt.Errorf("unknown line endings %q, use lf, crlf or auto", m.LineEndings)
 }
 
 // import resolution: sort imports by number of aliases.
@@ -258,8 +3433,65 @@ func (m *Maker) MakeInterface(pkgName, ifaceName string) ([]byte, error) {
 // where n is a number so that the alias is free.
 
 type method struct {
+	Name string
 	Code string
 	Docs []string
+
+	receiver string
+	funcType *ast.FuncType
+	// annotations are the names of the //ifacemaker: directives in the docs.
+	annotations []string
+	// scope is the scope the signature was rendered in.
+	scope          *signatureScope
+	file           *sourceFile
+	recvTypeParams []string
+	// recvName is the name of the receiver, which the examples in the docs
+	// usually call the method on.
+	recvName     string
+	pointerRecv  bool
+	position     token.Position
+	matchesBuild bool
+	// duplicates are the declarations of the same method in other files.
+	duplicates []*method
+}
+
+// sourceFile is what the methods keep of the file declaring them, so that
+// the rest of its AST, e.g. the function bodies, can be released.
+type sourceFile struct {
+	imports    []*ast.ImportSpec
+	dotImports bool
+	// constraint is the expression of the build constraints of the file.
+	constraint string
+	// comments are only kept for ParamComments.
+	comments []*ast.CommentGroup
+}
+
+// signatureScope describes the identifiers visible in a method signature
+// that do not necessarily refer to declarations of the source package.
+type signatureScope struct {
+	// dotImports is true if the file declaring the method has dot imports.
+	dotImports bool
+	// typeParams maps the type parameter names used by the receiver to the
+	// names used by the type declaration.
+	typeParams map[string]string
+}
+
+// newSignatureScope creates the scope of a signature declared in a file
+// with dotImports. The type parameter names in from are renamed to the names
+// in to; if to is nil, the names are kept.
+func newSignatureScope(dotImports bool, from, to []string) *signatureScope {
+	s := &signatureScope{
+		dotImports: dotImports,
+		typeParams: make(map[string]string),
+	}
+	for i, name := range from {
+		if to != nil {
+			s.typeParams[name] = to[i]
+		} else {
+			s.typeParams[name] = name
+		}
+	}
+	return s
 }
 
 type importedPkg struct {
@@ -292,6 +3524,13 @@ func (m *Maker) getReceiverTypeName(fl interface{}) (string, *ast.FuncDecl) {
 	if st, stok := t.(*ast.StarExpr); stok {
 		t = st.X
 	}
+	// Receivers of generic types list the type parameters.
+	switch it := t.(type) {
+	case *ast.IndexExpr:
+		t = it.X
+	case *ast.IndexListExpr:
+		t = it.X
+	}
 
 	ident, ok := t.(*ast.Ident)
 	if !ok {
@@ -301,12 +3540,60 @@ func (m *Maker) getReceiverTypeName(fl interface{}) (string, *ast.FuncDecl) {
 
 }
 
-func (m *Maker) printParameters(fl *ast.FieldList) (string, error) {
+// isPointerReceiver reports whether the receiver of fd is a pointer.
+func isPointerReceiver(fd *ast.FuncDecl) bool {
+	_, ok := fd.Recv.List[0].Type.(*ast.StarExpr)
+	return ok
+}
+
+// receiverTypeParams returns the type parameter names of a method's receiver,
+// e.g. [K V] for func (m *Map[K, V]) Get(key K) V.
+func receiverTypeParams(fd *ast.FuncDecl) []string {
+	t := fd.Recv.List[0].Type
+	if st, ok := t.(*ast.StarExpr); ok {
+		t = st.X
+	}
+	var indices []ast.Expr
+	switch it := t.(type) {
+	case *ast.IndexExpr:
+		indices = []ast.Expr{it.Index}
+	case *ast.IndexListExpr:
+		indices = it.Indices
+	}
+	var names []string
+	for _, index := range indices {
+		if ident, ok := index.(*ast.Ident); ok {
+			names = append(names, ident.Name)
+		}
+	}
+	return names
+}
+
+// fieldNames returns the names declared by fl, in order.
+func fieldNames(fl *ast.FieldList) []string {
+	if fl == nil {
+		return nil
+	}
+	var names []string
+	for _, field := range fl.List {
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+	}
+	return names
+}
+
+// printParameters prints the fields of fl separated by commas. If comments is
+// not nil, the comments between the fields are carried through.
+func (m *Maker) printParameters(fl *ast.FieldList, scope *signatureScope, comments []*ast.CommentGroup) (string, error) {
 	if fl == nil {
 		return "", nil
 	}
 	buff := &bytes.Buffer{}
 	ll := len(fl.List)
+	if ll > 0 && fl.Opening.IsValid() {
+		writeComments(buff, commentsBetween(comments, fl.Opening, fl.List[0].Pos()))
+	}
 	for ii, field := range fl.List {
 		l := len(field.Names)
 		for i, name := range field.Names {
@@ -315,106 +3602,266 @@ func (m *Maker) printParameters(fl *ast.FieldList) (string, error) {
 				return "", errors.Wrap(err, "failed printing parameter name")
 			}
 			if i < l-1 {
-				fmt.Fprint(buff, ",")
+				fmt.Fprint(buff, ", ")
 			} else {
 				fmt.Fprint(buff, " ")
 			}
 		}
 
-		typeBuff := &bytes.Buffer{}
-		err := printer.Fprint(typeBuff, m.fset, field.Type)
+		err := printer.Fprint(buff, m.fset, m.qualifyExpr(field.Type, scope))
 		if err != nil {
 			return "", errors.Wrap(err, "failed printing parameter type")
 		}
-		buff.Write(m.replaceType(typeBuff).Bytes())
+
+		next := fl.Closing
 		if ii < ll-1 {
+			next = fl.List[ii+1].Pos()
+		}
+		fieldComments := commentsBetween(comments, field.End(), next)
+		// A line comment ends the line, so the last field needs a trailing
+		// comma before the closing parenthesis on the next line.
+		if ii < ll-1 || endsWithLineComment(fieldComments) {
 			fmt.Fprint(buff, ",")
 		}
+		writeComments(buff, fieldComments)
+		if ii < ll-1 && !endsWithLineComment(fieldComments) {
+			fmt.Fprint(buff, " ")
+		}
 	}
 
 	return buff.String(), nil
 }
 
-func (m *Maker) replaceTypeOld(in *bytes.Buffer) *bytes.Buffer {
-	if m.srcPackage == "" {
-		return in
+// commentsBetween returns the comments positioned between from and to.
+func commentsBetween(comments []*ast.CommentGroup, from, to token.Pos) []*ast.Comment {
+	var between []*ast.Comment
+	for _, group := range comments {
+		for _, c := range group.List {
+			if c.Pos() >= from && c.End() <= to {
+				between = append(between, c)
+			}
+		}
 	}
+	return between
+}
 
-	s := in.String()
+func endsWithLineComment(comments []*ast.Comment) bool {
+	return len(comments) > 0 && strings.HasPrefix(comments[len(comments)-1].Text, "//")
+}
 
-	// No uppercase then this is not exported
-	if !strings.ContainsAny(s, "ABCDEFGHIGKLMNOPQRSTUVWXYZ") {
-		return in
-	}
-	// Already qualified with a package prefix
-	if strings.Contains(s, ".") {
-		return in
+// writeComments writes comments, ending each line comment with a newline.
+func writeComments(buff *bytes.Buffer, comments []*ast.Comment) {
+	for _, c := range comments {
+		fmt.Fprint(buff, " ", c.Text)
+		if strings.HasPrefix(c.Text, "//") {
+			fmt.Fprint(buff, "\n")
+		}
 	}
+}
 
-	funcPrefix, s := removePrefix(s, "func(")
-	chanPrefix, s := removePrefix(s, "chan ", "<-chan ", "chan<- ")
+// shouldQualify reports whether the exported identifier name, used in a method
+// signature, refers to a package-level declaration of the source package and
+// must therefore be prefixed with the source package name.
+func (m *Maker) shouldQualify(name string, scope *signatureScope) bool {
+	if m.srcPackage == "" || !ast.IsExported(name) {
+		return false
+	}
+	if _, ok := m.declarations[name]; ok {
+		return true
+	}
+	// The identifier is not declared in any of the parsed files. Without a dot
+	// import it can only be declared in a file of the package that was not
+	// parsed; with one, it most likely comes from the dot imported package.
+	return !scope.dotImports
+}
 
-	ptrPrefix, s := removePrefix(s, "*")
+// qualifyExpr returns a copy of the type expression e in which every
+// identifier referring to a declaration of the source package is qualified
+// with the source package name. The original expression is left untouched.
+func (m *Maker) qualifyExpr(e ast.Expr, scope *signatureScope) ast.Expr {
+	q := func(e ast.Expr) ast.Expr {
+		if e == nil {
+			return nil
+		}
+		return m.qualifyExpr(e, scope)
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		if name, ok := scope.typeParams[t.Name]; ok {
+			// Type parameters shadow package-level declarations.
+			return &ast.Ident{NamePos: t.NamePos, Name: name}
+		}
+		if _, declared := m.declarations[t.Name]; t.Name == "any" && !declared && m.targetsBefore(genericsVersion) {
+			return &ast.InterfaceType{Interface: t.NamePos, Methods: &ast.FieldList{Opening: t.NamePos, Closing: t.NamePos}}
+		}
+		if m.shouldQualify(t.Name, scope) {
+			return &ast.SelectorExpr{
+				X:   &ast.Ident{NamePos: t.NamePos, Name: m.srcPackage},
+				Sel: ast.NewIdent(t.Name),
+			}
+		}
+	case *ast.StarExpr:
+		c := *t
+		c.X = q(t.X)
+		return &c
+	case *ast.IndexExpr:
+		c := *t
+		c.X = q(t.X)
+		c.Index = q(t.Index)
+		return &c
+	case *ast.IndexListExpr:
+		c := *t
+		c.X = q(t.X)
+		c.Indices = make([]ast.Expr, len(t.Indices))
+		for i, index := range t.Indices {
+			c.Indices[i] = q(index)
+		}
+		return &c
+	case *ast.ParenExpr:
+		c := *t
+		c.X = q(t.X)
+		return &c
+	case *ast.UnaryExpr:
+		c := *t
+		c.X = q(t.X)
+		return &c
+	case *ast.BinaryExpr:
+		c := *t
+		c.X = q(t.X)
+		c.Y = q(t.Y)
+		return &c
+	case *ast.ArrayType:
+		c := *t
+		c.Len = q(t.Len)
+		c.Elt = q(t.Elt)
+		return &c
+	case *ast.Ellipsis:
+		c := *t
+		c.Elt = q(t.Elt)
+		return &c
+	case *ast.MapType:
+		c := *t
+		c.Key = q(t.Key)
+		c.Value = q(t.Value)
+		return &c
+	case *ast.ChanType:
+		c := *t
+		c.Value = q(t.Value)
+		return &c
+	case *ast.FuncType:
+		c := *t
+		c.Params = m.qualifyFieldList(t.Params, scope)
+		c.Results = m.qualifyFieldList(t.Results, scope)
+		return &c
+	case *ast.StructType:
+		c := *t
+		c.Fields = m.qualifyFieldList(t.Fields, scope)
+		return &c
+	case *ast.InterfaceType:
+		c := *t
+		c.Methods = m.qualifyFieldList(t.Methods, scope)
+		return &c
+	}
+	// Selector expressions are already qualified, and literals need no
+	// qualification.
+	return e
+}
 
-	// prepend the source package to the exported type
-	s = funcPrefix + chanPrefix + ptrPrefix + m.srcPackage + "." + s
+// qualifyFieldList returns a copy of fl with all field types qualified.
+func (m *Maker) qualifyFieldList(fl *ast.FieldList, scope *signatureScope) *ast.FieldList {
+	if fl == nil {
+		return nil
+	}
+	c := *fl
+	c.List = make([]*ast.Field, len(fl.List))
+	for i, field := range fl.List {
+		f := *field
+		f.Type = m.qualifyExpr(field.Type, scope)
+		c.List[i] = &f
+	}
+	return &c
+}
 
-	return bytes.NewBufferString(s)
+// VetError lists the problems Vet found in generated code.
+type VetError struct {
+	Filename string
+	Findings []string
 }
 
-func (m *Maker) replaceType(in *bytes.Buffer) (out *bytes.Buffer) {
-	if m.srcPackage == "" {
-		return in
+func (e *VetError) Error() string {
+	lines := []string{fmt.Sprintf("vetting the generated code for %s failed:", e.Filename)}
+	for _, finding := range e.Findings {
+		lines = append(lines, "\t"+finding)
 	}
-	out = &bytes.Buffer{}
-	var err error
-	var r rune
-	var p rune
-
-	// i've got 99 problems but regex isn't one of them
+	return strings.Join(lines, "\n")
+}
 
-	// https://golang.org/ref/spec#Identifiers
-	isValidTypeRune := func(r rune) bool {
-		return r == rune('_') || unicode.IsLetter(r) || unicode.IsDigit(r)
+// Vet type checks the generated code src, which is going to be written to
+// filename, to catch generation bugs that formatting alone cannot, such as
+// references to undefined packages or types. Imported packages are type
+// checked from source, located relative to the directory of filename.
+func (m *Maker) Vet(src []byte, filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.AllErrors)
+	if err != nil {
+		return newParseError(filename, err)
 	}
+	e := &VetError{Filename: filename}
+	conf := types.Config{
+		GoVersion: m.targetGoVersion(),
+		Importer:  importer.ForCompiler(fset, "source", nil),
+		Error: func(err error) {
+			e.Findings = append(e.Findings, err.Error())
+		},
+	}
+	conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+	if len(e.Findings) > 0 {
+		return e
+	}
+	return nil
+}
 
-	addPrefix := func(current rune, previous rune) bool {
-		// for already qualified
-		if previous == rune('.') {
-			return false
-		}
-		// continuing an identifier
-		if isValidTypeRune(previous) {
-			return false
+// generatedComment matches the comment marking generated files,
+// see https://golang.org/s/generatedcode.
+var generatedComment = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// IsGenerated reports whether the Go source src carries the comment marking
+// generated files before its first non-comment, non-blank text.
+func IsGenerated(src []byte) bool {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if generatedComment.MatchString(line) {
+			return true
 		}
-		// not part of an identifier
-		if !isValidTypeRune(current) {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "//") {
 			return false
 		}
-		// only exported
-		// https://golang.org/ref/spec#Exported_identifiers
-		return unicode.IsUpper(current)
 	}
-
-	for r, _, err = in.ReadRune(); err != io.EOF; {
-		if addPrefix(r, p) {
-			out.WriteString(m.srcPackage + ".")
-		}
-		out.WriteRune(r)
-		p = r
-		r, _, err = in.ReadRune()
-	}
-
-	return out
+	return false
 }
 
-func removePrefix(s string, variations ...string) (removed string, remainder string) {
-	for _, pfx := range variations {
-		if strings.HasPrefix(s, pfx) {
-			return pfx, strings.TrimPrefix(s, pfx)
+const invocationPrefix = "//ifacemaker:invocation "
+
+// ReadInvocation returns the Invocation recorded in the header of the
+// generated Go source src, and whether it has one.
+func ReadInvocation(src []byte) (string, bool) {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, invocationPrefix) {
+			return strings.TrimPrefix(line, invocationPrefix), true
+		}
+		if line != "" && !strings.HasPrefix(line, "//") {
+			break
 		}
 	}
-	return "", s
+	return "", false
 }
 
 func formatCode(code string) ([]byte, error) {
@@ -427,51 +3874,380 @@ func formatCode(code string) ([]byte, error) {
 	return imports.Process("", []byte(code), opts)
 }
 
-func (m *Maker) GetGoFiles(paths ...string) (allFiles []string, err error) {
+// GetGoFiles returns the Go files of paths, which are files or directories
+// whose Go files are listed in name order.
+func (m *Maker) GetGoFiles(paths ...string) ([]string, error) {
+	var allFiles []string
+	err := m.WalkGoFiles(paths, func(filename string) error {
+		allFiles = append(allFiles, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allFiles, nil
+}
+
+// WalkGoFiles calls fn for the Go files of paths in the order of GetGoFiles,
+// as they are found. It stops at the first error returned by fn.
+func (m *Maker) WalkGoFiles(paths []string, fn func(filename string) error) error {
+	return m.walkGoFiles(paths, func(w walkedFile) error {
+		if w.warning != "" {
+			m.warnf("%s", w.warning)
+		}
+		if w.skip {
+			return nil
+		}
+		return fn(w.name)
+	})
+}
 
-	var noFiles []string
+// walkedFile is a Go file found by walkGoFiles.
+type walkedFile struct {
+	name string
+	// warning is set if the file exceeds MaxFileSize, and skip if it is
+	// skipped for it.
+	warning string
+	skip    bool
+}
 
+// walkGoFiles calls fn for the Go files of paths as they are found, without
+// listing them all first. It stops at the first error returned by fn.
+func (m *Maker) walkGoFiles(paths []string, fn func(walkedFile) error) error {
+	count := 0
 	for _, f := range paths {
+		f = normalizePath(f)
 		fi, err := os.Stat(f)
 		if err != nil {
-			return noFiles, err
+			return err
 		}
-		if fi.IsDir() {
-			dir, err := os.Open(f)
-			if err != nil {
-				return noFiles, err
+		if !fi.IsDir() {
+			count++
+			if err := m.checkMaxFiles(count, f); err != nil {
+				return err
+			}
+			if err := fn(walkedFile{name: f}); err != nil {
+				return err
 			}
-			dirFiles, err := dir.Readdir(-1)
-			dir.Close()
+			continue
+		}
+		err = fs.WalkDir(os.DirFS(f), ".", func(p string, d fs.DirEntry, err error) error {
 			if err != nil {
-				return noFiles, err
+				if p == "." {
+					err = unwrapPathError(err, f)
+				}
+				return err
 			}
-			var dirFileNames []string
-			for _, fi := range dirFiles {
-				if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".go") {
-					dirFileNames = append(dirFileNames, filepath.Join(f, fi.Name()))
+			if d.IsDir() {
+				if p == "." {
+					return nil
 				}
+				return fs.SkipDir
 			}
-			sort.Strings(dirFileNames)
-			allFiles = append(allFiles, dirFileNames...)
-		} else {
-			allFiles = append(allFiles, f)
+			if !strings.HasSuffix(d.Name(), ".go") {
+				return nil
+			}
+			w := walkedFile{name: filepath.Join(f, filepath.FromSlash(p))}
+			if m.MaxFileSize > 0 {
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if fi.Size() > m.MaxFileSize {
+					if m.SkipLargeFiles {
+						w.warning = fmt.Sprintf("skipping %s: its size of %d bytes exceeds the limit of %d bytes", w.name, fi.Size(), m.MaxFileSize)
+						w.skip = true
+						return fn(w)
+					}
+					w.warning = fmt.Sprintf("%s has a size of %d bytes, exceeding the limit of %d bytes; it may slow down the generation, consider skipping large files",
+						w.name, fi.Size(), m.MaxFileSize)
+				}
+			}
+			count++
+			if err := m.checkMaxFiles(count, f); err != nil {
+				return err
+			}
+			return fn(w)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrapPathError returns the error of the file system operation on the
+// directory dir, with its path instead of the one relative to dir.
+func unwrapPathError(err error, dir string) error {
+	if pe, ok := err.(*fs.PathError); ok && pe.Path == "." {
+		return &fs.PathError{Op: pe.Op, Path: dir, Err: pe.Err}
+	}
+	return err
+}
+
+// checkMaxFiles returns an error if count, the number of Go files found
+// until reading the path f, exceeds MaxFiles.
+func (m *Maker) checkMaxFiles(count int, f string) error {
+	if m.MaxFiles > 0 && count > m.MaxFiles {
+		return fmt.Errorf("more than %d Go files found after reading %s: narrow the input or raise the limit", m.MaxFiles, f)
+	}
+	return nil
+}
+
+// normalizePath converts the separators of p to the separators of the
+// operating system, so that paths written on Windows, e.g. in go:generate
+// directives, work elsewhere too.
+func normalizePath(p string) string {
+	if filepath.Separator != '\\' && strings.Contains(p, "\\") {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			// A backslash is a valid file name character here, so only
+			// treat it as a separator if the path does not exist as is.
+			p = strings.Replace(p, "\\", "/", -1)
 		}
 	}
-	return allFiles, err
+	return filepath.Clean(filepath.FromSlash(p))
 }
 
+// ParseFiles parses the source files, reading and parsing up to Workers of
+// them concurrently. Files that do not mention the struct cannot contribute
+// methods and are skipped after checking their package clause, unless their
+// declarations are needed to resolve a dot import.
 func (m *Maker) ParseFiles(files ...string) error {
-	for _, f := range files {
-		src, err := ioutil.ReadFile(f)
-		if err != nil {
+	m.init()
+	done := make(chan struct{})
+	defer close(done)
+	walked := make(chan walkedFile)
+	go func() {
+		defer close(walked)
+		for _, f := range files {
+			select {
+			case walked <- walkedFile{name: f}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return m.parseWalked(walked, done)
+}
+
+// ParsePaths parses the Go files of paths like ParseFiles, which are files or
+// directories as for GetGoFiles. The files are parsed as they are found, so
+// that parsing starts before the directories are read completely.
+func (m *Maker) ParsePaths(paths ...string) error {
+	m.init()
+	done := make(chan struct{})
+	defer close(done)
+	walked := make(chan walkedFile)
+	var walkErr error
+	go func() {
+		defer close(walked)
+		walkErr = m.walkGoFiles(paths, func(w walkedFile) error {
+			select {
+			case walked <- w:
+				return nil
+			case <-done:
+				return errStopWalk
+			}
+		})
+	}()
+	if err := m.parseWalked(walked, done); err != nil {
+		return err
+	}
+	// The walk is over once all the results are received.
+	return walkErr
+}
+
+// errStopWalk stops walkGoFiles once the parsing failed.
+var errStopWalk = errors.New("walk stopped")
+
+// parseWalked parses the files received from walked until it is closed, in
+// their order.
+func (m *Maker) parseWalked(walked <-chan walkedFile, done chan struct{}) error {
+
+	fileParsed := func(filename string, skipped bool, elapsed time.Duration) {
+		if m.FileParsed != nil {
+			m.FileParsed(filename, skipped, elapsed)
+		}
+	}
+	var skipped []string
+	for result := range m.parseAll(walked, done) {
+		r := <-result
+		if r.warning != "" {
+			m.warnf("%s", r.warning)
+		}
+		if r.excluded {
+			continue
+		}
+		if r.skipped {
+			skipped = append(skipped, r.filename)
+			continue
+		}
+		err := r.err
+		if err == nil {
+			err = m.addParsed(r)
+		}
+		m.releaseFile(r.filename)
+		if err := m.checkParseError(r.filename, err); err != nil {
 			return err
 		}
-		err = m.ParseSource(src, filepath.Base(f))
+		if err == nil {
+			fileParsed(r.filename, false, r.elapsed)
+		}
+	}
+
+	parse := m.parsePackageClause
+	if m.dotImports {
+		parse = m.ParseSource
+	}
+	for _, f := range skipped {
+		start := time.Now()
+		src, err := m.readFile(f)
 		if err != nil {
 			return err
 		}
+		err = parse(src, f)
+		m.releaseFile(f)
+		if err == nil && !m.dotImports {
+			m.stats.FilesSkipped++
+		}
+		if err := m.checkParseError(f, err); err != nil {
+			return err
+		}
+		if err == nil {
+			fileParsed(f, !m.dotImports, time.Since(start))
+		}
+	}
+	return nil
+}
+
+// parsedFile is the result of reading and parsing a source file.
+type parsedFile struct {
+	filename string
+	src      []byte
+	file     *ast.File
+	// skipped is set if the file does not mention the struct.
+	skipped bool
+	err     error
+	elapsed time.Duration
+	// warning and excluded are set from the walkedFile.
+	warning  string
+	excluded bool
+}
+
+// parseAll reads and parses the files received from walked in goroutines,
+// sending a channel for the result of each file in the order they are
+// received. At most Workers files are pending at once, which bounds the
+// memory used by large packages.
+func (m *Maker) parseAll(walked <-chan walkedFile, done <-chan struct{}) <-chan chan *parsedFile {
+	workers := m.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	pending := make(chan chan *parsedFile, workers)
+	go func() {
+		defer close(pending)
+		for w := range walked {
+			result := make(chan *parsedFile, 1)
+			if w.skip {
+				result <- &parsedFile{filename: w.name, warning: w.warning, excluded: true}
+			} else {
+				go func(w walkedFile) {
+					r := m.readAndParse(w.name)
+					r.warning = w.warning
+					result <- r
+				}(w)
+			}
+			select {
+			case pending <- result:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return pending
+}
+
+// readAndParse reads and parses the file filename. It may be called
+// concurrently.
+func (m *Maker) readAndParse(filename string) (r *parsedFile) {
+	r = &parsedFile{filename: filename}
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			r.err = panicError(filename, p)
+		}
+		r.elapsed = time.Since(start)
+	}()
+	src, err := m.readFile(filename)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if !m.mayContribute(src) {
+		r.skipped = true
+		return r
+	}
+	r.src, r.file, r.err = m.parseFile(src, filename)
+	return r
+}
+
+// addParsed adds the declarations of the parsed file r.
+func (m *Maker) addParsed(r *parsedFile) (err error) {
+	m.current = nil
+	defer m.recoverPanic(&err, r.filename)
+	return m.addFile(r.src, r.file, r.filename)
+}
+
+// checkParseError returns err, unless it is a ParseError and ContinueOnError
+// is set, in which case the file f is skipped with a warning.
+func (m *Maker) checkParseError(f string, err error) error {
+	if pe, ok := err.(*ParseError); ok && m.ContinueOnError {
+		m.stats.FilesFailed++
+		m.warnf("skipping %s, which cannot be parsed:%s", f, pe.details())
+		return nil
+	}
+	return err
+}
+
+// mayContribute reports whether src mentions the struct, as a cheap check
+// before parsing it. Promoted methods and copied types can be declared in any
+// file.
+func (m *Maker) mayContribute(src []byte) bool {
+	if m.StructName == "" || m.Promote || m.CopyTypes {
+		return true
+	}
+	name := []byte(m.StructName)
+	for i := 0; ; {
+		j := bytes.Index(src[i:], name)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(name)
+		if (start == 0 || !isIdentByte(src[start-1])) && (end == len(src) || !isIdentByte(src[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// isIdentByte reports whether b can be part of an identifier. Bytes of
+// multi-byte characters count as such, as they are only valid in
+// identifiers, strings and comments.
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= utf8.RuneSelf ||
+		'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// parsePackageClause records the package of a skipped source file, for the
+// check that all files belong to the same package.
+func (m *Maker) parsePackageClause(src []byte, filename string) error {
+	m.init()
+	src = bytes.TrimPrefix(src, utf8BOM)
+	a, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.PackageClauseOnly)
+	if err != nil {
+		return newParseError(filename, err)
 	}
+	m.addPackageFile(a.Name.Name, filename)
 	return nil
 }
 
@@ -489,7 +4265,7 @@ func (m *Maker) ReadStructs(files ...string) (allStructs map[string]int32, err e
 			return allStructs, err
 		}
 
-		st, err := m.ParseDeclarations(src, filepath.Base(f))
+		st, err := m.ParseDeclarations(src, f)
 		if err != nil {
 			return allStructs, err
 		}
@@ -501,3 +4277,58 @@ func (m *Maker) ReadStructs(files ...string) (allStructs map[string]int32, err e
 
 	return
 }
+
+// Target is an interface generated by a run over several structs.
+type Target struct {
+	StructName string
+	IfaceName  string
+	// Output is the file the interface is written to, empty for stdout.
+	Output string
+	// GOOS and GOARCH, if set, select the build configuration of a variant
+	// of the interface.
+	GOOS, GOARCH string
+}
+
+// CheckTargets returns an error listing the targets that would generate
+// interfaces with the same name in the same directory or write the same
+// output file, so that they do not silently overwrite each other.
+func CheckTargets(targets []Target) error {
+	type key struct{ dir, name, goos, goarch string }
+	var ifaceKeys, outputKeys []key
+	ifaces := make(map[key][]string)
+	outputs := make(map[key][]string)
+	for _, t := range targets {
+		dir := "."
+		if t.Output != "" {
+			dir = filepath.Dir(filepath.Clean(t.Output))
+			k := key{name: filepath.Clean(t.Output)}
+			if len(outputs[k]) == 0 {
+				outputKeys = append(outputKeys, k)
+			}
+			outputs[k] = append(outputs[k], t.StructName)
+		}
+		k := key{dir: dir, name: t.IfaceName, goos: t.GOOS, goarch: t.GOARCH}
+		if len(ifaces[k]) == 0 {
+			ifaceKeys = append(ifaceKeys, k)
+		}
+		ifaces[k] = append(ifaces[k], t.StructName)
+	}
+
+	var conflicts []string
+	for _, k := range ifaceKeys {
+		if structs := ifaces[k]; len(structs) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("interface %s in %s is generated for %s",
+				k.name, k.dir, strings.Join(structs, ", ")))
+		}
+	}
+	for _, k := range outputKeys {
+		if structs := outputs[k]; len(structs) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("output %s is written for %s",
+				k.name, strings.Join(structs, ", ")))
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("conflicting targets:\n\t%s", strings.Join(conflicts, "\n\t"))
+}
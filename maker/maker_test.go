@@ -2,8 +2,17 @@ package maker
 
 import (
 	"bytes"
+	"fmt"
 	"go/format"
+	"go/parser"
+	"go/printer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -82,7 +91,8 @@ type HumanIface interface {
 
 	require.Nil(maker.ParseSource([]byte(src), "human.go"))
 
-	result := maker.makeInterface("interfaces", "HumanIface")
+	result, err := maker.makeInterface("interfaces", "HumanIface")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -148,7 +158,8 @@ type HumanIface interface {
 
 	require.Nil(maker.ParseSource([]byte(src), "human.go"))
 
-	result := maker.makeInterface("interfaces", "HumanIface")
+	result, err := maker.makeInterface("interfaces", "HumanIface")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -184,7 +195,8 @@ type IFoo interface {
 
 	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -237,7 +249,8 @@ type IFoo interface {
 	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
 	require.Nil(maker.ParseSource([]byte(src2), "foo2.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -407,7 +420,8 @@ type IFoo interface {
 	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
 	require.Nil(maker.ParseSource([]byte(src2), "foo2.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -451,7 +465,8 @@ type IFoo interface {
 
 	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -505,7 +520,8 @@ type IFoo interface {
 	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
 	require.Nil(maker.ParseSource([]byte(src2), "foo2.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -555,7 +571,8 @@ type IFoo interface {
 
 	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
 
-	result := maker.makeInterface("interfaces", "IFoo")
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
 	formatted, err := format.Source([]byte(result))
 	require.Nil(err)
 	require.Equal(expected, string(formatted))
@@ -565,10 +582,14 @@ func TestReplaceType(t *testing.T) {
 	require := require.New(t)
 
 	m := &Maker{srcPackage: "foo"}
+	m.init()
 
 	rig := func(in string) string {
-		buffer := bytes.NewBufferString(in)
-		return m.replaceType(buffer).String()
+		expr, err := parser.ParseExpr(in)
+		require.Nil(err)
+		buffer := &bytes.Buffer{}
+		require.Nil(printer.Fprint(buffer, m.fset, m.qualifyExpr(expr, &signatureScope{})))
+		return buffer.String()
 	}
 
 	// already qualified
@@ -587,4 +608,2818 @@ func TestReplaceType(t *testing.T) {
 
 	require.Equal("func(bool, *foo.List) *foo.Bar", rig("func(bool, *List) *Bar"))
 
+	// nested function, channel, map and slice types
+	require.Equal("func(cb func(foo.Event) error) error", rig("func(cb func(Event) error) error"))
+	require.Equal("func(Handler func(foo.Event)) foo.Handler", rig("func(Handler func(Event)) Handler"))
+	require.Equal("map[foo.Key][]chan<- func(*foo.Msg) (foo.Reply, error)", rig("map[Key][]chan<- func(*Msg) (Reply, error)"))
+	require.Equal("<-chan <-chan []*foo.Event", rig("<-chan <-chan []*Event"))
+	require.Equal("func(...foo.Option)", rig("func(...Option)"))
+
+	// field and method names are not qualified
+	require.Equal("struct{ Name foo.Label }", rig("struct{ Name Label }"))
+	require.Equal("interface{ Handle(foo.Event) error }", rig("interface{ Handle(Event) error }"))
+	require.Equal("interface{ foo.Handler }", rig("interface{ Handler }"))
+}
+
+func TestArrayLengthQualification(t *testing.T) {
+	require := require.New(t)
+
+	src1 := `package store
+
+const MaxKeyLen = 16
+
+type Store struct {
+}
+
+func (s *Store) Key() [MaxKeyLen]byte {
+	return [MaxKeyLen]byte{}
+}
+`
+	src2 := `package store
+
+import (
+	. "github.com/user/limits"
+)
+
+func (s *Store) Value() [MaxValueLen]byte {
+	return [MaxValueLen]byte{}
+}
+
+func (s *Store) Pair() [2 * MaxKeyLen]Item {
+	return [2 * MaxKeyLen]Item{}
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"github.com/user/store"
+)
+
+var _ IStore = (*store.Store)(nil)
+
+type IStore interface {
+	Key() [store.MaxKeyLen]byte
+	Value() [MaxValueLen]byte
+	Pair() [2 * store.MaxKeyLen]Item
+}
+`
+
+	maker := &Maker{
+		StructName: "Store",
+		CopyDocs:   true,
+	}
+	maker.AddImport("", "github.com/user/store")
+	maker.SourcePackage("store")
+
+	require.Nil(maker.ParseSource([]byte(src1), "store1.go"))
+	require.Nil(maker.ParseSource([]byte(src2), "store2.go"))
+
+	result, err := maker.makeInterface("interfaces", "IStore")
+	require.Nil(err)
+	formatted, err := format.Source([]byte(result))
+	require.Nil(err)
+	require.Equal(expected, string(formatted))
+}
+
+func TestAssertImport(t *testing.T) {
+	require := require.New(t)
+
+	src := `package store
+
+import "time"
+
+type Store struct {
+}
+
+func (s *Store) Expiry() time.Duration {
+	return 0
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"time"
+
+	storage "github.com/user/store/v2"
+)
+
+var _ IStore = (*storage.Store)(nil)
+
+type IStore interface {
+	Expiry() time.Duration
+}
+`
+
+	maker := &Maker{
+		StructName:   "Store",
+		AssertImport: "github.com/user/store/v2",
+	}
+	require.Nil(maker.ParseSource([]byte(strings.Replace(src, "package store", "package storage", 1)), "store.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IStore")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+
+	maker = &Maker{
+		StructName:   "Store",
+		AssertImport: "github.com/user/store",
+	}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+
+	_, err = maker.MakeInterface("interfaces", "store")
+	require.EqualError(err, `interface name "store" collides with the name of the source package github.com/user/store`)
+
+	maker = &Maker{
+		StructName:   "Store",
+		AssertImport: "github.com/user/cmd",
+	}
+	require.Nil(maker.ParseSource([]byte(strings.Replace(src, "package store", "package main", 1)), "store.go"))
+
+	_, err = maker.MakeInterface("interfaces", "IStore")
+	require.EqualError(err, "cannot assert that Store implements IStore: package main cannot be imported")
+}
+
+func TestMakeAssertions(t *testing.T) {
+	require := require.New(t)
+
+	src := `package store
+
+import "time"
+
+type Store struct {
+}
+
+func (s *Store) Expiry() time.Duration {
+	return 0
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"time"
+)
+
+type IStore interface {
+	Expiry() time.Duration
+}
+`
+
+	maker := &Maker{
+		StructName:        "Store",
+		AssertImport:      "github.com/user/store",
+		SeparateAssertion: true,
+	}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IStore")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+
+	assertion, err := maker.Assertion("IStore")
+	require.Nil(err)
+	require.Equal(Assertion{Import: "github.com/user/store", Package: "store", Struct: "Store", Iface: "IStore"}, assertion)
+
+	other := Assertion{Import: "github.com/other/store", Package: "store", Struct: "Store", Iface: "IOtherStore",
+		IfaceImport: "github.com/other/interfaces", IfacePackage: "interfaces"}
+	expected = `// Code generated by ifacemaker. DO NOT EDIT.
+
+package zz
+
+import (
+	"github.com/other/interfaces"
+	store2 "github.com/other/store"
+	"github.com/user/store"
+)
+
+var (
+	_ IStore                 = (*store.Store)(nil)
+	_ interfaces.IOtherStore = (*store2.Store)(nil)
+)
+`
+	// IStore is declared in the package of the assertions.
+	result, err = MakeAssertions("zz", []Assertion{assertion, other, other})
+	require.Nil(err)
+	require.Equal(expected, string(result))
+
+	_, err = (&Maker{StructName: "Store"}).Assertion("IStore")
+	require.EqualError(err, "no import path of the package of Store to assert that it implements IStore")
+}
+
+func TestGenericInstantiations(t *testing.T) {
+	require := require.New(t)
+
+	src := `package coll
+
+import "github.com/user/pkg"
+
+type Item struct {
+}
+
+type Key string
+
+type List[T any] struct {
+}
+
+type Cache[K comparable, V Constraint] struct {
+}
+
+func (l *List[E]) Get(i int) E {
+	var e E
+	return e
+}
+
+func (l *List[T]) Items() List[Item] {
+	return List[Item]{}
+}
+
+func (l *List[T]) Index() map[Key]pkg.Value[Item] {
+	return nil
+}
+
+func (l *List[T]) Pairs(c Cache[Key, T]) pkg.Pair[T, Item] {
+	return pkg.Pair[T, Item]{}
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"github.com/user/coll"
+	"github.com/user/pkg"
+)
+
+func _[T any]() {
+	var _ IList[T] = (*coll.List[T])(nil)
+}
+
+type IList[T any] interface {
+	Get(i int) T
+	Items() coll.List[coll.Item]
+	Index() map[coll.Key]pkg.Value[coll.Item]
+	Pairs(c coll.Cache[coll.Key, T]) pkg.Pair[T, coll.Item]
+}
+`
+
+	maker := &Maker{
+		StructName: "List",
+		CopyDocs:   true,
+	}
+	maker.AddImport("", "github.com/user/coll")
+	maker.SourcePackage("coll")
+
+	require.Nil(maker.ParseSource([]byte(src), "coll.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IList")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestGenericConstraints(t *testing.T) {
+	require := require.New(t)
+
+	src := `package coll
+
+type Number interface {
+	~int | ~float64
+}
+
+type Cache[K comparable, V Number] struct {
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var v V
+	return v, false
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import ()
+
+func _[K comparable, V coll.Number]() {
+	var _ ICache[K, V] = (*coll.Cache[K, V])(nil)
+}
+
+type ICache[K comparable, V coll.Number] interface {
+	Get(key K) (V, bool)
+}
+`
+
+	maker := &Maker{
+		StructName: "Cache",
+		CopyDocs:   true,
+	}
+	maker.SourcePackage("coll")
+
+	require.Nil(maker.ParseSource([]byte(src), "coll.go"))
+
+	result, err := maker.makeInterface("interfaces", "ICache")
+	require.Nil(err)
+	formatted, err := format.Source([]byte(result))
+	require.Nil(err)
+	require.Equal(expected, string(formatted))
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	require := require.New(t)
+
+	srcFoo := `//go:build foo
+
+package main
+
+type Foo struct {
+}
+
+func (f Foo) Handle(fd int) error {
+	return nil
+}
+`
+	srcNotFoo := `//go:build !foo
+
+package main
+
+func (f Foo) Handle(fd uintptr) error {
+	return nil
+}
+`
+	srcSame := `//go:build !foo
+
+package main
+
+func (f Foo) Handle(fd int) error {
+	return nil
+}
+`
+
+	parse := func(policy DuplicatePolicy, srcs ...string) (string, error) {
+		maker := &Maker{
+			StructName:      "Foo",
+			DuplicatePolicy: policy,
+			BuildTags:       []string{"foo"},
+		}
+		for i, src := range srcs {
+			require.Nil(maker.ParseSource([]byte(src), fmt.Sprintf("foo%d.go", i+1)))
+		}
+		result, err := maker.makeInterface("interfaces", "IFoo")
+		if err != nil {
+			return "", err
+		}
+		formatted, err := format.Source([]byte(result))
+		require.Nil(err)
+		return string(formatted), nil
+	}
+
+	result, err := parse("", srcNotFoo, srcFoo)
+	require.Nil(err)
+	require.Contains(result, "Handle(fd uintptr) error")
+
+	_, err = parse(DuplicateError, srcFoo, srcNotFoo)
+	require.NotNil(err)
+	require.Equal("method Handle is declared more than once: foo1.go:8:1, foo2.go:5:1", err.Error())
+
+	result, err = parse(DuplicateBuild, srcNotFoo, srcFoo)
+	require.Nil(err)
+	require.Contains(result, "Handle(fd int) error")
+
+	_, err = parse(DuplicateBuild, srcFoo, srcFoo)
+	require.NotNil(err)
+	require.Contains(err.Error(), "2 of the declarations foo1.go:8:1, foo2.go:8:1 match")
+
+	_, err = parse(DuplicateIdentical, srcFoo, srcNotFoo)
+	require.NotNil(err)
+	require.Equal(`method Handle has different signatures: "Handle(fd int) error" at foo1.go:8:1 and "Handle(fd uintptr) error" at foo2.go:5:1`, err.Error())
+
+	result, err = parse(DuplicateIdentical, srcFoo, srcSame)
+	require.Nil(err)
+	require.Contains(result, "Handle(fd int) error")
+
+	_, err = parse("newest", srcFoo, srcSame)
+	require.NotNil(err)
+	require.Equal(`unknown duplicate policy "newest"`, err.Error())
+}
+
+func TestPromotedMethods(t *testing.T) {
+	require := require.New(t)
+
+	src1 := `package main
+
+import (
+	"io"
+	"sync"
+)
+
+type Reader struct {
+}
+
+// Read reads from the reader.
+func (r *Reader) Read(w io.Writer) error {
+	return nil
+}
+
+func (r *Reader) Close() error {
+	return nil
+}
+
+type Writer struct {
+}
+
+func (w Writer) Close() error {
+	return nil
+}
+
+func (w Writer) Name() string {
+	return ""
+}
+
+type Foo struct {
+	*Reader
+	Writer
+	sync.Mutex
+}
+
+func (f *Foo) Name() string {
+	return "foo"
+}
+`
+	src2 := `package main
+
+import "github.com/user/pkg"
+
+func (w Writer) Write(v pkg.Value) error {
+	return nil
+}
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"io"
+
+	"github.com/user/pkg"
+)
+
+type IFoo interface {
+	Name() string
+	// Read reads from the reader.
+	Read(w io.Writer) error
+	Write(v pkg.Value) error
+}
+`
+
+	maker := &Maker{
+		StructName: "Foo",
+		CopyDocs:   true,
+		Promote:    true,
+	}
+
+	require.Nil(maker.ParseSource([]byte(src1), "foo1.go"))
+	require.Nil(maker.ParseSource([]byte(src2), "foo2.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Equal([]string{
+		"methods promoted from embedded field sync.Mutex of Foo are not included: it is not declared in the parsed files",
+		"method Close is promoted from more than one embedded field of Foo (Reader, Writer) and is excluded as ambiguous",
+	}, maker.Warnings())
+}
+
+func TestEmbeddedInterfaces(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Inner struct{}
+
+func (Inner) Reset() {}
+
+type Base struct {
+	Inner
+}
+
+func (b *Base) Get() string { return "" }
+
+type Logger struct{}
+
+func (Logger) Log(msg string) {}
+
+func (Logger) Flush() error { return nil }
+
+type Foo struct {
+	*Base
+	Logger
+}
+
+func (f *Foo) Log(msg string) {}
+
+func (f *Foo) Name() string { return "foo" }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+type IFoo interface {
+	IBase
+	Log(msg string)
+	Name() string
+	Flush() error
+}
+`
+
+	maker := &Maker{
+		StructName:         "Foo",
+		Promote:            true,
+		EmbeddedInterfaces: map[string]string{"Base": "IBase", "Logger": "ILogger"},
+	}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Equal([]string{
+		"the methods promoted from embedded field Logger of Foo are listed instead of embedding ILogger, as some of them are shadowed or ambiguous",
+	}, maker.Warnings())
+
+	// The stubs still implement the methods of the embedded interfaces.
+	maker = &Maker{
+		StructName:         "Foo",
+		Promote:            true,
+		EmbeddedInterfaces: map[string]string{"Base": "IBase"},
+		Unimplemented:      UnimplementedPanic,
+	}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	result, err = maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "func (UnimplementedIFoo) Get() string {")
+	require.Contains(string(result), "func (UnimplementedIFoo) Reset() {")
+}
+
+func TestDuplicateWarnings(t *testing.T) {
+	require := require.New(t)
+
+	src1 := `package main
+
+type Foo struct {
+}
+
+func (f Foo) Foo() string {
+	return "hand-written"
+}
+`
+	src2 := `// Code generated by stringer. DO NOT EDIT.
+
+package main
+
+func (f Foo) Foo() string {
+	return "generated"
+}
+
+func (f Foo) String() string {
+	return "generated"
+}
+`
+
+	maker := &Maker{
+		StructName: "Foo",
+	}
+
+	require.Nil(maker.ParseSource([]byte(src1), "foo.go"))
+	require.Nil(maker.ParseSource([]byte(src2), "foo_string.go"))
+
+	_, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal([]string{
+		"method Foo declared at foo_string.go:5:1 is ignored, the declaration at foo.go:6:1 is used instead",
+	}, maker.Warnings())
+}
+
+func TestParseErrors(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.go")
+	broken := filepath.Join(dir, "broken.go")
+	require.Nil(ioutil.WriteFile(good, []byte(`package main
+
+type Foo struct {
+}
+
+func (f Foo) Bar() {
+}
+`), 0644))
+	require.Nil(ioutil.WriteFile(broken, []byte(`package main
+
+func (f Foo) Baz( {
+}
+
+func (f Foo) Qux() int {
+	return 1 +
+}
+`), 0644))
+
+	maker := &Maker{StructName: "Foo"}
+	files, err := maker.GetGoFiles(dir)
+	require.Nil(err)
+	err = maker.ParseFiles(files...)
+	require.NotNil(err)
+	require.Contains(err.Error(), "parsing "+broken+" failed:\n\t"+broken+":3:19: ")
+	require.True(len(err.(*ParseError).Errors) > 1)
+
+	maker = &Maker{StructName: "Foo", ContinueOnError: true}
+	require.Nil(maker.ParseFiles(files...))
+	require.Equal(1, len(maker.Warnings()))
+	require.Contains(maker.Warnings()[0], "skipping "+broken+", which cannot be parsed:\n\t"+broken+":3:19: ")
+
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Contains(result, "Bar()")
+}
+
+func TestValidateNames(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import "github.com/user/store"
+
+type Foo struct {
+}
+
+func (f Foo) Get(key string) (store.Value, error) {
+	return store.Value{}, nil
+}
+`
+
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	generate := func(pkgName, ifaceName string) string {
+		_, err := maker.MakeInterface(pkgName, ifaceName)
+		require.NotNil(err)
+		return err.Error()
+	}
+
+	require.Equal(`invalid package name "github.com/user/mocks": use the package name instead of the import path, e.g. "mocks"`,
+		generate("github.com/user/mocks", "IFoo"))
+	require.Equal(`invalid package name "my-mocks": it must be a Go identifier other than _`,
+		generate("my-mocks", "IFoo"))
+	require.Equal(`invalid package name "func": it must be a Go identifier other than _`,
+		generate("func", "IFoo"))
+	require.Equal(`invalid interface name "Foo Iface": it must be a Go identifier other than _, e.g. "FooIface"`,
+		generate("mocks", "Foo Iface"))
+	require.Equal(`interface name "store" collides with the imported package store used by method Get at foo.go:8:1`,
+		generate("mocks", "store"))
+
+	maker.SourcePackage("main")
+	require.Equal(`interface name "main" collides with the package name used by --rewrite`,
+		generate("mocks", "main"))
+}
+
+func TestResultLists(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Foo struct {
+}
+
+func (f Foo) Run() {
+}
+
+func (f Foo) Close() error {
+	return nil
+}
+
+func (f Foo) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func (f Foo) Len() (n int) {
+	return 0
+}
+
+func (f Foo) Func() func() error {
+	return nil
+}
+`
+
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	result, err := maker.makeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Contains(result, "\nRun()\n")
+	require.Contains(result, "\nClose() error\n")
+	require.Contains(result, "\nRead(p []byte) (int, error)\n")
+	require.Contains(result, "\nLen() (n int)\n")
+	require.Contains(result, "\nFunc() func() error\n")
+}
+
+func TestParamComments(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Foo struct {
+}
+
+// List lists the items.
+func (f Foo) List(limit int, // max 100
+	offset int /* from the start */, order string,
+) (items []string, // sorted by order
+	err error) {
+	// the body is not copied
+	return nil, nil
+}
+
+func (f Foo) Close( /* nothing */ ) error /* ignored */ {
+	return nil
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+type IFoo interface {
+	// List lists the items.
+	List(limit int, // max 100
+		offset int /* from the start */, order string) (items []string, // sorted by order
+		err error)
+	Close() error
+}
+`
+
+	maker := &Maker{
+		StructName:    "Foo",
+		CopyDocs:      true,
+		ParamComments: true,
+	}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestLineEndings(t *testing.T) {
+	require := require.New(t)
+
+	src := "package main\r\n\r\ntype Foo struct {\r\n}\r\n\r\n/* Bar does\r\n   nothing. */\r\nfunc (f Foo) Bar() {\r\n}\r\n"
+	expected := "// Code generated by ifacemaker. DO NOT EDIT.\n\npackage interfaces\n\ntype IFoo interface {\n\t/* Bar does\n   nothing. */\n\tBar()\n}\n"
+
+	generate := func(le LineEndings) string {
+		maker := &Maker{StructName: "Foo", CopyDocs: true, LineEndings: le}
+		require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+		result, err := maker.MakeInterface("interfaces", "IFoo")
+		require.Nil(err)
+		return string(result)
+	}
+
+	require.Equal(expected, generate(""))
+	require.Equal(expected, generate(LF))
+	require.Equal(strings.Replace(expected, "\n", "\r\n", -1), generate(CRLF))
+	require.Equal(strings.Replace(expected, "\n", "\r\n", -1), generate(AutoLineEndings))
+
+	maker := &Maker{StructName: "Foo", LineEndings: "cr"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	_, err := maker.MakeInterface("interfaces", "IFoo")
+	require.NotNil(err)
+	require.Equal(`unknown line endings "cr", use lf, crlf or auto`, err.Error())
+}
+
+func TestWindowsSeparators(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "sub", "foo.go"), []byte("package main\n"), 0644))
+
+	maker := &Maker{}
+	files, err := maker.GetGoFiles(dir + `\sub\foo.go`)
+	require.Nil(err)
+	require.Equal([]string{filepath.Join(dir, "sub", "foo.go")}, files)
+
+	files, err = maker.GetGoFiles(dir + `\sub\`)
+	require.Nil(err)
+	require.Equal([]string{filepath.Join(dir, "sub", "foo.go")}, files)
+}
+
+func TestFileLimits(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	small := filepath.Join(dir, "small.go")
+	large := filepath.Join(dir, "large.pb.go")
+	require.Nil(ioutil.WriteFile(small, []byte("package main\n"), 0644))
+	require.Nil(ioutil.WriteFile(large, bytes.Repeat([]byte("// generated\n"), 100), 0644))
+
+	maker := &Maker{MaxFileSize: 1000}
+	files, err := maker.GetGoFiles(dir)
+	require.Nil(err)
+	require.Equal([]string{large, small}, files)
+	require.Equal([]string{
+		large + " has a size of 1300 bytes, exceeding the limit of 1000 bytes; it may slow down the generation, consider skipping large files",
+	}, maker.Warnings())
+
+	maker = &Maker{MaxFileSize: 1000, SkipLargeFiles: true}
+	files, err = maker.GetGoFiles(dir)
+	require.Nil(err)
+	require.Equal([]string{small}, files)
+	require.Equal([]string{
+		"skipping " + large + ": its size of 1300 bytes exceeds the limit of 1000 bytes",
+	}, maker.Warnings())
+
+	// explicitly listed files are not limited
+	files, err = maker.GetGoFiles(large)
+	require.Nil(err)
+	require.Equal([]string{large}, files)
+
+	maker = &Maker{MaxFiles: 1}
+	_, err = maker.GetGoFiles(dir)
+	require.NotNil(err)
+	require.Equal("more than 1 Go files found after reading "+dir+": narrow the input or raise the limit", err.Error())
+}
+
+func TestIsGenerated(t *testing.T) {
+	require := require.New(t)
+
+	require.True(IsGenerated([]byte("// Code generated by ifacemaker. DO NOT EDIT.\n\npackage foo\n")))
+	require.True(IsGenerated([]byte("// Copyright\r\n\r\n// Code generated by mockgen. DO NOT EDIT.\r\npackage foo\r\n")))
+	require.True(IsGenerated([]byte("//go:build linux\n\n// Code generated by ifacemaker. DO NOT EDIT.\n\npackage foo\n")))
+	require.False(IsGenerated([]byte("package foo\n\n// Code generated by ifacemaker. DO NOT EDIT.\n")))
+	require.False(IsGenerated([]byte("// Package foo is hand-written.\npackage foo\n")))
+	require.False(IsGenerated([]byte("// Code generated by ifacemaker.\npackage foo\n")))
+	require.False(IsGenerated(nil))
+}
+
+func TestUnusedAddedImport(t *testing.T) {
+	require := require.New(t)
+
+	src := `package nats
+
+type Conn struct {
+}
+
+func (nc *Conn) Publish(msg *Msg) error {
+	return nil
+}
+`
+
+	maker := &Maker{StructName: "Conn"}
+	maker.AddImport("", "github.com/nats-io/nats")
+	maker.AddImport("", "github.com/nats-io/stan")
+	maker.SourcePackage("nats")
+	require.Nil(maker.ParseSource([]byte(src), "nats.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IConn")
+	require.Nil(err)
+	require.Contains(string(result), `"github.com/nats-io/nats"`)
+	require.Equal([]string{
+		`added import "github.com/nats-io/stan" is not used by the generated interface and was removed, check the import path and the rewrite package prefix`,
+	}, maker.Warnings())
+}
+
+func TestVet(t *testing.T) {
+	require := require.New(t)
+
+	maker := &Maker{}
+
+	require.Nil(maker.Vet([]byte(`package interfaces
+
+import "io"
+
+type IFoo interface {
+	Copy(w io.Writer) error
+}
+`), "foo_iface.go"))
+
+	err := maker.Vet([]byte(`package interfaces
+
+import "io"
+
+type IFoo interface {
+	Copy(w io.Writer) nats.Msg
+	Copy(r io.Reader) error
+}
+`), "foo_iface.go")
+	require.NotNil(err)
+	findings := err.(*VetError).Findings
+	require.True(len(findings) >= 2)
+	require.Contains(findings[0], "foo_iface.go:6:20: undefined: nats")
+	require.Contains(findings[1], "foo_iface.go:7:2: duplicate method Copy")
+}
+
+func TestMixedPackages(t *testing.T) {
+	require := require.New(t)
+
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte("package foo\n\ntype Foo struct{}\n\nfunc (f Foo) Bar() {}\n"), "foo.go"))
+	require.Nil(maker.ParseSource([]byte("package foo_test\n"), "foo_test.go"))
+	require.Nil(maker.ParseSource([]byte("package main\n\nfunc (f Foo) Baz() {}\n"), "gen.go"))
+	require.Nil(maker.ParseSource([]byte("package foo\n"), "doc.go"))
+
+	_, err := maker.makeInterface("interfaces", "IFoo")
+	require.NotNil(err)
+	require.Equal("the source files belong to different packages: "+
+		"package foo (foo.go, foo_test.go, doc.go), package main (gen.go); "+
+		"list only the files of the package declaring Foo instead of their directory", err.Error())
+}
+
+func TestRecoverPanic(t *testing.T) {
+	require := require.New(t)
+
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte("package main\n\ntype Foo struct{}\n\nfunc (f Foo) Bar() {}\n"), "foo.go"))
+
+	process := func() (err error) {
+		defer maker.recoverPanic(&err, "foo.go")
+		maker.current = maker.methods[0].funcType
+		panic("unexpected node")
+	}
+	err := process()
+	require.NotNil(err)
+	require.Regexp(`^ifacemaker \S+ failed processing foo.go:5:1: unexpected node; this is a bug`, err.Error())
+
+	process = func() (err error) {
+		defer maker.recoverPanic(&err, "bar.go")
+		maker.current = nil
+		panic("unexpected node")
+	}
+	err = process()
+	require.NotNil(err)
+	require.Regexp(`^ifacemaker \S+ failed processing bar.go: unexpected node`, err.Error())
+}
+
+func TestGoVersion(t *testing.T) {
+	require := require.New(t)
+
+	src := `package coll
+
+type List[T any] struct {
+}
+
+func (l *List[T]) Len() int {
+	return 0
+}
+`
+
+	maker := &Maker{StructName: "List", GoVersion: "go1.17"}
+	err := maker.ParseSource([]byte(src), "coll.go")
+	require.NotNil(err)
+	require.Equal("coll.go:3:10: type parameters require go1.18, but the Go version is go1.17", err.Error())
+
+	maker = &Maker{StructName: "List", GoVersion: "go1.18"}
+	require.Nil(maker.ParseSource([]byte(src), "coll.go"))
+	result, err := maker.MakeInterface("interfaces", "IList")
+	require.Nil(err)
+	require.Nil(maker.Vet(result, "list_iface.go"))
+
+	maker.GoVersion = "go1.17"
+	err = maker.Vet(result, "list_iface.go")
+	require.NotNil(err)
+	require.Contains(err.Error(), "requires go1.18")
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(os.Mkdir(filepath.Join(dir, "pkg"), 0755))
+	v, err := ModuleGoVersion(filepath.Join(dir, "pkg"))
+	require.Nil(err)
+	require.Equal("", v)
+
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/m\n\ngo 1.21\n\ntoolchain go1.22.1\n"), 0644))
+	v, err = ModuleGoVersion(filepath.Join(dir, "pkg"))
+	require.Nil(err)
+	require.Equal("go1.21", v)
+}
+
+func TestDocFormatting(t *testing.T) {
+	require := require.New(t)
+
+	src := "package main\n\n" +
+		"type Doc struct{}\n\n" +
+		"// Example:\n" +
+		"//   d.Do(1,\n" +
+		"//        2)\n" +
+		"//\n" +
+		"func (d *Doc) Do(a, b int) {}\n\n" +
+		"/*\n" +
+		"Run runs.\n" +
+		"    indented\n" +
+		"\ttabbed\n" +
+		"\n" +
+		"*/\n" +
+		"func (d *Doc) Run() {}\n\n" +
+		"/* Inline is inline. */  // Really.\n" +
+		"func (d *Doc) Inline() {}\n"
+
+	expected := "// Code generated by ifacemaker. DO NOT EDIT.\n\n" +
+		"package main\n\n" +
+		"type IDoc interface {\n" +
+		"\t// Example:\n" +
+		"\t//   d.Do(1,\n" +
+		"\t//        2)\n" +
+		"\t//\n" +
+		"\tDo(a, b int)\n" +
+		"\t/*\n" +
+		"Run runs.\n" +
+		"    indented\n" +
+		"\ttabbed\n" +
+		"\n" +
+		"*/\n" +
+		"\tRun()\n" +
+		"\t/* Inline is inline. */  // Really.\n" +
+		"\tInline()\n" +
+		"}\n"
+
+	maker := &Maker{StructName: "Doc", CopyDocs: true}
+	require.Nil(maker.ParseSource([]byte(src), "doc.go"))
+	result, err := maker.MakeInterface("main", "IDoc")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestDocDirectives(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Dir struct{}
+
+// Gen generates code.
+//
+//go:generate rm -rf /
+//go:noinline
+func (d *Dir) Gen() {}
+
+// Check checks. //nolint:lll
+//nolint:errcheck // The error is always nil.
+func (d *Dir) Check() error { return nil }
+
+//nolint
+func (d *Dir) Lint() {}
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+type IDir interface {
+	// Gen generates code.
+	Gen()
+	// Check checks.
+	// The error is always nil.
+	Check() error
+	Lint()
+}
+`
+
+	maker := &Maker{StructName: "Dir", CopyDocs: true}
+	require.Nil(maker.ParseSource([]byte(src), "dir.go"))
+	result, err := maker.MakeInterface("main", "IDir")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestIterSignatures(t *testing.T) {
+	require := require.New(t)
+
+	src := `package coll
+
+import "iter"
+
+type Item struct{}
+
+type Store[K comparable, V any] struct{}
+
+func (s *Store[K, V]) All() iter.Seq2[K, V] { return nil }
+func (s *Store[K, V]) Keys() iter.Seq[K] { return nil }
+func (s *Store[K, V]) Items() iter.Seq[Item] { return nil }
+func (s *Store[K, V]) Pairs() iter.Seq2[Item, *Item] { return nil }
+func (s *Store[K, V]) Nested() iter.Seq[iter.Seq[map[K][]Item]] { return nil }
+func (s *Store[K, V]) Each(yield func(K, V) bool) {}
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"iter"
+)
+
+func _[K comparable, V any]() {
+	var _ IStore[K, V] = (*coll.Store[K, V])(nil)
+}
+
+type IStore[K comparable, V any] interface {
+	All() iter.Seq2[K, V]
+	Keys() iter.Seq[K]
+	Items() iter.Seq[coll.Item]
+	Pairs() iter.Seq2[coll.Item, *coll.Item]
+	Nested() iter.Seq[iter.Seq[map[K][]coll.Item]]
+	Each(yield func(K, V) bool)
+}
+`
+
+	maker := &Maker{StructName: "Store", srcPackage: "coll"}
+	require.Nil(maker.ParseSource([]byte(src), "coll.go"))
+	result, err := maker.MakeInterface("interfaces", "IStore")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestUnsafeSignatures(t *testing.T) {
+	require := require.New(t)
+
+	src := `package lowlevel
+
+import "unsafe"
+
+type Pointer struct{}
+
+const Size = unsafe.Sizeof(uintptr(0))
+
+type Wrapper struct{}
+
+func (w *Wrapper) Raw() *[unsafe.Sizeof(uintptr(0))]byte { return nil }
+func (w *Wrapper) Buf() [Size]byte { return [Size]byte{} }
+func (w *Wrapper) Convert(f func(unsafe.Pointer) uintptr) Pointer { return Pointer{} }
+func (w *Wrapper) Addr() (uintptr, *Pointer, unsafe.Pointer) { return 0, nil, nil }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+import (
+	"unsafe"
+)
+
+var _ IWrapper = (*lowlevel.Wrapper)(nil)
+
+type IWrapper interface {
+	Raw() *[unsafe.Sizeof(uintptr(0))]byte
+	Buf() [lowlevel.Size]byte
+	Convert(f func(unsafe.Pointer) uintptr) lowlevel.Pointer
+	Addr() (uintptr, *lowlevel.Pointer, unsafe.Pointer)
+}
+`
+
+	maker := &Maker{StructName: "Wrapper", srcPackage: "lowlevel"}
+	require.Nil(maker.ParseSource([]byte(src), "lowlevel.go"))
+	result, err := maker.MakeInterface("interfaces", "IWrapper")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestCheckTargets(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(CheckTargets([]Target{
+		{StructName: "Foo", IfaceName: "IFoo", Output: "foo.go"},
+		{StructName: "Bar", IfaceName: "IBar", Output: "bar.go"},
+		{StructName: "Baz", IfaceName: "IFoo", Output: "baz/baz.go"},
+		{StructName: "Bar", IfaceName: "IBar", Output: "bar_linux.go", GOOS: "linux"},
+		{StructName: "Bar", IfaceName: "IBar", Output: "bar_windows_amd64.go", GOOS: "windows", GOARCH: "amd64"},
+	}))
+
+	err := CheckTargets([]Target{
+		{StructName: "Foo", IfaceName: "IFoo", Output: "iface/foo.go"},
+		{StructName: "Bar", IfaceName: "IFoo", Output: "iface/bar.go"},
+		{StructName: "Baz", IfaceName: "IBaz", Output: "iface/./foo.go"},
+		{StructName: "Qux", IfaceName: "IQux"},
+		{StructName: "Quux", IfaceName: "IQux"},
+	})
+	require.NotNil(err)
+	require.Equal("conflicting targets:\n"+
+		"\tinterface IFoo in iface is generated for Foo, Bar\n"+
+		"\tinterface IQux in . is generated for Qux, Quux\n"+
+		"\toutput iface/foo.go is written for Foo, Baz", err.Error())
+}
+
+func TestEncoding(t *testing.T) {
+	require := require.New(t)
+
+	src := "\xef\xbb\xbfpackage main\n\ntype Foo struct{}\n\nfunc (f *Foo) Bar() {}\n"
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte(src), "bom.go"))
+	result, err := maker.MakeInterface("main", "IFoo")
+	require.Nil(err)
+	require.Equal("// Code generated by ifacemaker. DO NOT EDIT.\n\npackage main\n\ntype IFoo interface {\n\tBar()\n}\n", string(result))
+	require.True(IsGenerated(append([]byte("\xef\xbb\xbf"), result...)))
+
+	src = "package main\n\n// Caf\xe9 \xe9\nfunc (f *Foo) Baz() {}\n\nvar s = \"\xff\"\n"
+	err = (&Maker{StructName: "Foo"}).ParseSource([]byte(src), "latin1.go")
+	require.NotNil(err)
+	require.IsType(&ParseError{}, err)
+	require.Equal("parsing latin1.go failed:\n"+
+		"\tlatin1.go:3:7: invalid UTF-8 byte 0xe9, the file must be UTF-8 encoded\n"+
+		"\tlatin1.go:6:10: invalid UTF-8 byte 0xff, the file must be UTF-8 encoded", err.Error())
+
+	err = (&Maker{StructName: "Foo"}).ParseSource([]byte("\xff\xfep\x00"), "utf16.go")
+	require.NotNil(err)
+	require.Equal("parsing utf16.go failed: the file is UTF-16 encoded, convert it to UTF-8", err.Error())
+}
+
+func TestBlankIdentifiers(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Blank struct{}
+
+func (_ Blank) One(_ int, s string) {}
+func (Blank) Two(_, _ int) (_ bool, err error) { return }
+func (_ *Blank) Three(_ int, _ ...string) {}
+func (*Blank) Four(func(_ int) error) {}
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+type IBlank interface {
+	One(_ int, s string)
+	Two(_, _ int) (_ bool, err error)
+	Three(_ int, _ ...string)
+	Four(func(_ int) error)
+}
+`
+
+	maker := &Maker{StructName: "Blank"}
+	require.Nil(maker.ParseSource([]byte(src), "blank.go"))
+	result, err := maker.MakeInterface("main", "IBlank")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Nil(maker.Vet(result, "blank_iface.go"))
+}
+
+func TestNoResultNames(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Res struct{}
+
+func (r *Res) Read(p []byte) (n int, err error) { return }
+func (r *Res) Pair() (a, b int) { return }
+func (r *Res) One() (ok bool) { return }
+func (r *Res) Plain() (int, error) { return 0, nil }
+func (r *Res) Fn() (f func() (x int)) { return }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+type IRes interface {
+	Read(p []byte) (%s)
+	Pair() (%s)
+	One() %s
+	Plain() (int, error)
+	Fn() %s
+}
+`
+
+	maker := &Maker{StructName: "Res"}
+	require.Nil(maker.ParseSource([]byte(src), "res.go"))
+	result, err := maker.MakeInterface("main", "IRes")
+	require.Nil(err)
+	require.Equal(fmt.Sprintf(expected, "n int, err error", "a, b int", "(ok bool)", "(f func() (x int))"), string(result))
+
+	maker = &Maker{StructName: "Res", NoResultNames: true}
+	require.Nil(maker.ParseSource([]byte(src), "res.go"))
+	result, err = maker.MakeInterface("main", "IRes")
+	require.Nil(err)
+	require.Equal(fmt.Sprintf(expected, "int, error", "int, int", "bool", "func() (x int)"), string(result))
+}
+
+func TestPromotionDepth(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Inner struct{}
+
+func (i *Inner) Open() error   { return nil }
+func (i *Inner) Close() error  { return nil }
+func (i *Inner) Name() string  { return "" }
+func (i *Inner) Flush() error  { return nil }
+func (i *Inner) Status() int   { return 0 }
+
+type Middle struct {
+	*Inner
+	Status string
+}
+
+func (m *Middle) Close() error { return nil }
+
+type Other struct {
+	Inner
+}
+
+func (o Other) Name() string { return "" }
+
+type Log struct{}
+
+func (l Log) Flush() error { return nil }
+
+type Outer struct {
+	Middle
+	Other
+	Log
+}
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+type IOuter interface {
+	Close() error
+	Name() string
+	Flush() error
+}
+`
+
+	maker := &Maker{StructName: "Outer", Promote: true}
+	require.Nil(maker.ParseSource([]byte(src), "outer.go"))
+	result, err := maker.MakeInterface("interfaces", "IOuter")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Equal([]string{
+		"method Open is promoted from more than one embedded field of Outer (Inner, Inner) and is excluded as ambiguous",
+	}, maker.Warnings())
+}
+
+func TestReleasedAST(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Foo struct{}
+
+func (f *Foo) Bar() {}
+
+type Other struct{}
+
+func (o *Other) Baz() {}
+`
+
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	require.Nil(maker.current)
+	require.Empty(maker.typeMethods)
+	require.Nil(maker.methods[0].file.comments)
+
+	maker = &Maker{StructName: "Foo", Promote: true}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	require.Len(maker.typeMethods["Other"], 1)
+}
+
+func TestParseMode(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(parser.SkipObjectResolution, (&Maker{}).parseMode())
+	require.Equal(parser.SkipObjectResolution|parser.ParseComments, (&Maker{CopyDocs: true}).parseMode())
+	require.Equal(parser.SkipObjectResolution|parser.ParseComments, (&Maker{ParamComments: true}).parseMode())
+
+	src := `package main
+
+type Foo struct{}
+
+// Bar does nothing.
+func (f *Foo) Bar(a int /* the a */) {}
+`
+	maker := &Maker{StructName: "Foo"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	result, err := maker.MakeInterface("main", "IFoo")
+	require.Nil(err)
+	require.Equal("// Code generated by ifacemaker. DO NOT EDIT.\n\npackage main\n\ntype IFoo interface {\n\tBar(a int)\n}\n", string(result))
+}
+
+func TestParseFilesPrefilter(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(ioutil.WriteFile(path, []byte(src), 0644))
+		return path
+	}
+	foo := write("foo.go", "package pkg\n\ntype Foo struct{}\n\nfunc (f *Foo) Get() Local { return Local{} }\n")
+	local := write("local.go", "package pkg\n\ntype Local struct{}\n")
+	broken := write("broken.go", "package pkg\n\nfunc broken() {\n")
+
+	maker := &Maker{StructName: "Foo", srcPackage: "pkg"}
+	require.Nil(maker.ParseFiles(foo, local, broken))
+	result, err := maker.MakeInterface("api", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "\tGet() pkg.Local\n")
+
+	// The declarations of the skipped files are needed with dot imports.
+	foo = write("foo.go", "package pkg\n\nimport . \"strings\"\n\ntype Foo struct{}\n\nfunc (f *Foo) Get(b *Builder) Local { return Local{} }\n")
+	maker = &Maker{StructName: "Foo", srcPackage: "pkg", ContinueOnError: true}
+	require.Nil(maker.ParseFiles(foo, local, broken))
+	result, err = maker.MakeInterface("api", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "\tGet(b *Builder) pkg.Local\n")
+	require.Len(maker.Warnings(), 1)
+
+	other := write("other.go", "package other\n")
+	maker = &Maker{StructName: "Foo", srcPackage: "pkg"}
+	require.Nil(maker.ParseFiles(foo, other))
+	_, err = maker.MakeInterface("api", "IFoo")
+	require.NotNil(err)
+	require.Contains(err.Error(), "other.go")
+}
+
+func TestStats(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(ioutil.WriteFile(path, []byte(src), 0644))
+		return path
+	}
+	foo := write("foo.go", "package pkg\n\ntype Foo struct{}\n\nfunc (f *Foo) Get() int { return 0 }\n\nfunc (f *Foo) Put(v int) {}\n\nfunc (f *Foo) reset() {}\n")
+	dup := write("foo_dup.go", "package pkg\n\nfunc (f *Foo) Get() int { return 1 }\n")
+	other := write("other.go", "package pkg\n\ntype Other struct{}\n")
+	broken := write("broken.go", "package pkg\n\nfunc (f *Foo) Broken() {\n")
+
+	maker := &Maker{StructName: "Foo", ContinueOnError: true}
+	require.Nil(maker.ParseFiles(foo, dup, other, broken))
+	_, err = maker.MakeInterface("api", "IFoo")
+	require.Nil(err)
+
+	stats := maker.Stats()
+	require.Equal(Stats{
+		FilesParsed:  2,
+		FilesSkipped: 1,
+		FilesFailed:  1,
+		Methods:      2,
+		SkippedMethods: map[SkipReason]int{
+			SkippedUnexported: 1,
+			SkippedDuplicate:  1,
+		},
+	}, stats)
+	require.Equal(4, stats.FilesScanned())
+}
+
+func TestParseFilesConcurrently(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	var files []string
+	for i := 0; i < 50; i++ {
+		src := fmt.Sprintf("package pkg\n\nfunc (f *Foo) Method%02d() {}\n", i)
+		if i%10 == 5 {
+			src = fmt.Sprintf("package pkg\n\nfunc (f *Foo) Broken%02d() {\n", i)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("foo%02d.go", i))
+		require.Nil(ioutil.WriteFile(path, []byte(src), 0644))
+		files = append(files, path)
+	}
+
+	var expected []byte
+	var expectedWarnings []string
+	for _, workers := range []int{1, 2, 8, 0} {
+		maker := &Maker{StructName: "Foo", ContinueOnError: true, Workers: workers}
+		require.Nil(maker.ParseFiles(files...))
+		result, err := maker.MakeInterface("pkg", "IFoo")
+		require.Nil(err)
+		require.Len(maker.Warnings(), 5)
+		if expected == nil {
+			expected, expectedWarnings = result, maker.Warnings()
+			require.Contains(string(result), "\tMethod00()\n\tMethod01()\n")
+			continue
+		}
+		require.Equal(string(expected), string(result))
+		require.Equal(expectedWarnings, maker.Warnings())
+	}
+
+	// the files of the directory are parsed as they are found, in order
+	for _, workers := range []int{1, 8} {
+		maker := &Maker{StructName: "Foo", ContinueOnError: true, Workers: workers}
+		require.Nil(maker.ParsePaths(dir))
+		result, err := maker.MakeInterface("pkg", "IFoo")
+		require.Nil(err)
+		require.Equal(string(expected), string(result))
+		require.Equal(expectedWarnings, maker.Warnings())
+	}
+
+	maker := &Maker{StructName: "Foo", Workers: 2}
+	err = maker.ParseFiles(files...)
+	require.NotNil(err)
+	require.Contains(err.Error(), "foo05.go")
+
+	maker = &Maker{StructName: "Foo", Workers: 2}
+	err = maker.ParsePaths(dir)
+	require.NotNil(err)
+	require.Contains(err.Error(), "foo05.go")
+}
+
+func TestParseCache(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package pkg\n\nimport \"io\"\n\ntype Foo struct{}\n\n// Read reads.\nfunc (f *Foo) Read(r io.Reader) {}\n"), 0644))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "bar.go"), []byte("package pkg\n\ntype Bar struct{}\n\nfunc (b Bar) Close() error { return nil }\n"), 0644))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "bar_windows.go"), []byte("package pkg\n\nfunc (b Bar) Handle() uintptr { return 0 }\n"), 0644))
+
+	generate := func(cache *ParseCache, structName, goos string) string {
+		maker := &Maker{StructName: structName, CopyDocs: true, Cache: cache}
+		if goos != "" {
+			maker.GOOS, maker.SkipExcludedFiles = goos, true
+		}
+		require.Nil(maker.ParsePaths(dir))
+		result, err := maker.MakeInterface("pkg", "I"+structName)
+		require.Nil(err)
+		return string(result)
+	}
+	foo, bar, barLinux := generate(nil, "Foo", ""), generate(nil, "Bar", ""), generate(nil, "Bar", "linux")
+	require.Contains(foo, "// Read reads.\n\tRead(r io.Reader)\n")
+	require.Contains(bar, "\tHandle() uintptr\n")
+	require.NotContains(barLinux, "Handle")
+
+	cache := NewParseCache(3)
+	require.Equal(foo, generate(cache, "Foo", ""))
+	require.Len(cache.files, 3)
+	require.Equal(bar, generate(cache, "Bar", ""))
+
+	// The last maker is given the files of the cache without reading them,
+	// as their contents are gone, and they are released once it is done.
+	for _, name := range []string{"foo.go", "bar.go", "bar_windows.go"} {
+		require.Nil(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	require.Equal(barLinux, generate(cache, "Bar", "linux"))
+	require.Empty(cache.files)
+}
+
+func TestParsePaths(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "sub")
+	require.Nil(os.Mkdir(sub, 0755))
+	foo := filepath.Join(dir, "foo.go")
+	large := filepath.Join(dir, "large.go")
+	require.Nil(ioutil.WriteFile(foo, []byte("package pkg\n\nfunc (f *Foo) Foo() {}\n"), 0644))
+	require.Nil(ioutil.WriteFile(large, []byte("package pkg\n\nfunc (f *Foo) Large() {}\n"+strings.Repeat("//\n", 100)), 0644))
+	require.Nil(ioutil.WriteFile(filepath.Join(sub, "sub.go"), []byte("package pkg\n\nfunc (f *Foo) Sub() {}\n"), 0644))
+
+	var parsed []string
+	maker := &Maker{StructName: "Foo", MaxFileSize: 100, SkipLargeFiles: true}
+	maker.FileParsed = func(filename string, skipped bool, elapsed time.Duration) {
+		parsed = append(parsed, filename)
+	}
+	require.Nil(maker.ParsePaths(dir))
+	require.Equal([]string{foo}, parsed)
+	require.Equal([]string{
+		"skipping " + large + ": its size of 338 bytes exceeds the limit of 100 bytes",
+	}, maker.Warnings())
+	result, err := maker.MakeInterface("pkg", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "\tFoo()\n}")
+
+	maker = &Maker{StructName: "Foo", MaxFiles: 1}
+	err = maker.ParsePaths(dir)
+	require.NotNil(err)
+	require.Equal("more than 1 Go files found after reading "+dir+": narrow the input or raise the limit", err.Error())
+
+	maker = &Maker{StructName: "Foo"}
+	err = maker.ParsePaths(filepath.Join(dir, "missing"))
+	require.NotNil(err)
+	require.True(os.IsNotExist(err))
+}
+
+func TestUnimplemented(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import "io"
+
+type Store[T any] struct{}
+
+func (s *Store[T]) Get(key string) (value T, err error) { return }
+func (s *Store[T]) Close() error                         { return nil }
+func (s *Store[T]) Len() int                             { return 0 }
+func (s *Store[T]) Pair(err int) (T, io.Reader, error)   { return *new(T), nil, nil }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+type IStore[T any] interface {
+	Get(key string) (value T, err error)
+	Close() error
+	Len() int
+	Pair(err int) (T, io.Reader, error)
+}
+
+// UnimplementedIStore can be embedded in implementations of IStore, so that they keep
+// compiling when methods are added to the interface.
+type UnimplementedIStore[T any] struct{}
+
+func (UnimplementedIStore[T]) Get(key string) (value T, err error) {
+	err = errors.New("IStore.Get is not implemented")
+	return
+}
+
+func (UnimplementedIStore[T]) Close() (err error) {
+	err = errors.New("IStore.Close is not implemented")
+	return
+}
+
+func (UnimplementedIStore[T]) Len() int {
+	panic("IStore.Len is not implemented")
+}
+
+func (UnimplementedIStore[T]) Pair(err int) (r0 T, r1 io.Reader, r2 error) {
+	r2 = errors.New("IStore.Pair is not implemented")
+	return
+}
+`
+
+	maker := &Maker{StructName: "Store", Unimplemented: UnimplementedError}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err := maker.MakeInterface("main", "IStore")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Nil(maker.Vet(result, "store_iface.go"))
+
+	maker = &Maker{StructName: "Store", Unimplemented: UnimplementedPanic}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err = maker.MakeInterface("main", "IStore")
+	require.Nil(err)
+	require.Contains(string(result), "func (UnimplementedIStore[T]) Close() error {\n\tpanic(\"IStore.Close is not implemented\")\n}\n")
+	require.NotContains(string(result), "errors")
+
+	maker = &Maker{StructName: "Store", Unimplemented: "maybe"}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	_, err = maker.MakeInterface("main", "IStore")
+	require.NotNil(err)
+	require.Equal(`unknown unimplemented mode "maybe", use error or panic`, err.Error())
+
+	// The errors package of the source file is not the standard one, and
+	// is kept for the signatures.
+	src = `package main
+
+import (
+	stderrors "github.com/user/stderrors"
+	"github.com/pkg/errors"
+)
+
+type Store struct{}
+
+func (s *Store) Close() errors.Frame { return 0 }
+func (s *Store) Flush() error { return stderrors.New("") }
+`
+	maker = &Maker{StructName: "Store", Unimplemented: UnimplementedError}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err = maker.MakeInterface("main", "IStore")
+	require.Nil(err)
+	require.Contains(string(result), `import (
+	stderrors2 "errors"
+
+	"github.com/pkg/errors"
+)
+`)
+	require.Contains(string(result), "\terr = stderrors2.New(\"IStore.Flush is not implemented\")\n")
+}
+
+func TestMultiplexer(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Hooks struct{}
+
+func (h *Hooks) OnStart(name string, _ int) error          { return nil }
+func (h *Hooks) OnEvent(name string, args ...interface{})  {}
+func (h *Hooks) Count() (n int)                            { return }
+func (h *Hooks) Query(impl int) (string, int, error)       { return "", 0, nil }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+import "errors"
+
+type IHooks interface {
+	OnStart(name string, _ int) error
+	OnEvent(name string, args ...interface{})
+	Count() (n int)
+	Query(impl int) (string, int, error)
+}
+
+// IHooksMultiplexer forwards the calls of IHooks to all of its implementations in order.
+// The errors are joined, and the other results are those of the last implementation.
+type IHooksMultiplexer []IHooks
+
+func (mux IHooksMultiplexer) OnStart(name string, p0 int) (err error) {
+	var errs []error
+	for _, impl := range mux {
+		if e := impl.OnStart(name, p0); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	err = errors.Join(errs...)
+	return
+}
+
+func (mux IHooksMultiplexer) OnEvent(name string, args ...interface{}) {
+	for _, impl := range mux {
+		impl.OnEvent(name, args...)
+	}
+}
+
+func (mux IHooksMultiplexer) Count() (n int) {
+	for _, impl := range mux {
+		n = impl.Count()
+	}
+	return
+}
+
+func (mux IHooksMultiplexer) Query(impl int) (r0 string, r1 int, err error) {
+	var errs []error
+	for _, impl0 := range mux {
+		var e error
+		r0, r1, e = impl0.Query(impl)
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	err = errors.Join(errs...)
+	return
+}
+`
+
+	maker := &Maker{StructName: "Hooks", Multiplexer: true, GoVersion: "go1.21"}
+	require.Nil(maker.ParseSource([]byte(src), "hooks.go"))
+	result, err := maker.MakeInterface("main", "IHooks")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Nil(maker.Vet(result, "hooks_iface.go"))
+
+	maker = &Maker{StructName: "Hooks", Multiplexer: true, GoVersion: "go1.21", TargetGoVersion: "go1.19"}
+	require.Nil(maker.ParseSource([]byte(src), "hooks.go"))
+	result, err = maker.MakeInterface("main", "IHooks")
+	require.Nil(err)
+	require.Contains(string(result), `// IHooksMultiplexer forwards the calls of IHooks to all of its implementations in order.
+// The first error is returned, and the other results are those of the last implementation.
+type IHooksMultiplexer []IHooks
+
+func (mux IHooksMultiplexer) OnStart(name string, p0 int) (err error) {
+	for _, impl := range mux {
+		if e := impl.OnStart(name, p0); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+`)
+	require.Contains(string(result), `
+func (mux IHooksMultiplexer) Query(impl int) (r0 string, r1 int, err error) {
+	for _, impl0 := range mux {
+		var e error
+		r0, r1, e = impl0.Query(impl)
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+`)
+	require.Nil(maker.Vet(result, "hooks_iface.go"))
+
+	// The errors package of the source file is not the standard one.
+	src = `package main
+
+import "github.com/pkg/errors"
+
+type Hooks struct{}
+
+func (h *Hooks) OnStart(name string) error { return errors.New(name) }
+`
+	maker = &Maker{StructName: "Hooks", Multiplexer: true, GoVersion: "go1.21"}
+	require.Nil(maker.ParseSource([]byte(src), "hooks.go"))
+	result, err = maker.MakeInterface("main", "IHooks")
+	require.Nil(err)
+	require.Contains(string(result), "import (\n\tstderrors \"errors\"\n)\n")
+	require.Contains(string(result), "\terr = stderrors.Join(errs...)\n")
+	require.Nil(maker.Vet(result, "hooks_iface.go"))
+}
+
+func TestCacheDecorator(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import "context"
+
+type Store struct{}
+
+// Get gets an item.
+//
+//ifacemaker:cache
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error)  { return nil, nil }
+func (s *Store) Keys() []string                                     { return nil }
+func (s *Store) Put(key string, value []byte) error                  { return nil }
+func (s *Store) KeysOf(prefixes ...string) []string                 { return nil }
+`
+
+	maker := &Maker{StructName: "Store", Decorators: []Decorator{DecoratorCache}, CacheMethods: regexp.MustCompile(`^Keys`)}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err := maker.MakeInterface("main", "IStore")
+	require.Nil(err)
+	require.Contains(string(result), `// IStoreCache caches the results of Get, Keys of the wrapped IStore.
+// The results are kept for TTL, or forever if it is zero, unless the call fails.
+// The other methods are forwarded. It is safe for concurrent use.
+type IStoreCache struct {
+	IStore
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]map[interface{}]iStoreCacheEntry
+}
+`)
+	require.Contains(string(result), `
+func (c *IStoreCache) Get(ctx context.Context, key string) (r0 []byte, err error) {
+	key0 := [1]interface{}{key}
+	if r, ok := c.load("Get", key0); ok {
+		r0, _ = r[0].([]byte)
+		return
+	}
+	r0, err = c.IStore.Get(ctx, key)
+	if err == nil {
+		c.store("Get", key0, r0)
+	}
+	return
+}
+
+func (c *IStoreCache) Keys() (r0 []string) {
+	key := [0]interface{}{}
+	if r, ok := c.load("Keys", key); ok {
+		r0, _ = r[0].([]string)
+		return
+	}
+	r0 = c.IStore.Keys()
+	c.store("Keys", key, r0)
+	return
+}
+`)
+	require.NotContains(string(result), "func (c *IStoreCache) Put")
+	require.NotContains(string(result), "func (c *IStoreCache) KeysOf")
+	require.Equal([]string{"method KeysOf is not cached: it is variadic"}, maker.Warnings())
+	require.Nil(maker.Vet(result, "store_iface.go"))
+
+	// The parameters whose values may not be map keys are resolved through
+	// the declared types.
+	src = `package main
+
+type Tags []string
+
+type Query struct {
+	Name string
+	Tags [2]Tag
+}
+
+type Tag string
+
+type Filter struct {
+	Tags Tags
+}
+
+type Store struct{}
+
+func (s *Store) Find(tags Tags) []string          { return nil }
+func (s *Store) Query(q Query) []string           { return nil }
+func (s *Store) Match(v interface{}) bool         { return false }
+func (s *Store) Filter(f *Filter, g Filter) []int { return nil }
+`
+	maker = &Maker{StructName: "Store", Decorators: []Decorator{DecoratorCache}, CacheMethods: regexp.MustCompile(`.`)}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err = maker.MakeInterface("main", "IStore")
+	require.Nil(err)
+	require.Contains(string(result), "// IStoreCache caches the results of Query of the wrapped IStore.\n")
+	require.Equal([]string{
+		"method Find is not cached: its parameters cannot be compared",
+		"method Match is not cached: its parameters cannot be compared",
+		"method Filter is not cached: its parameters cannot be compared",
+	}, maker.Warnings())
+
+	maker = &Maker{StructName: "Store", Decorators: []Decorator{"retry"}}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	_, err = maker.MakeInterface("main", "IStore")
+	require.NotNil(err)
+	require.Equal(`unknown decorator "retry", use cache or locked`, err.Error())
+}
+
+func TestLockedDecorator(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Counter struct{}
+
+//ifacemaker:readonly
+func (c *Counter) Get(key string) int                 { return 0 }
+func (c *Counter) Add(key string, _ int)                {}
+func (c *Counter) Keys(prefixes ...string) (l []string) { return nil }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+import "sync"
+
+type ICounter interface {
+	Get(key string) int
+	Add(key string, _ int)
+	Keys(prefixes ...string) (l []string)
+}
+
+// ICounterLocked serializes the calls of the wrapped ICounter, so that it is safe for
+// concurrent use.
+// The read-only methods Get, Keys may run concurrently.
+type ICounterLocked struct {
+	ICounter
+
+	mu sync.RWMutex
+}
+
+func (l *ICounterLocked) Get(key string) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.ICounter.Get(key)
+}
+
+func (l *ICounterLocked) Add(key string, p0 int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ICounter.Add(key, p0)
+}
+
+func (l0 *ICounterLocked) Keys(prefixes ...string) (l []string) {
+	l0.mu.RLock()
+	defer l0.mu.RUnlock()
+	return l0.ICounter.Keys(prefixes...)
+}
+`
+
+	maker := &Maker{StructName: "Counter", Decorators: []Decorator{DecoratorLocked}, ReadOnlyMethods: regexp.MustCompile(`^Keys$`)}
+	require.Nil(maker.ParseSource([]byte(src), "counter.go"))
+	result, err := maker.MakeInterface("main", "ICounter")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Nil(maker.Vet(result, "counter_iface.go"))
+
+	maker = &Maker{StructName: "Counter", Decorators: []Decorator{DecoratorLocked}}
+	require.Nil(maker.ParseSource([]byte(strings.Replace(src, "//ifacemaker:readonly\n", "", 1)), "counter.go"))
+	result, err = maker.MakeInterface("main", "ICounter")
+	require.Nil(err)
+	require.Contains(string(result), `// ICounterLocked serializes the calls of the wrapped ICounter, so that it is safe for
+// concurrent use.
+type ICounterLocked struct {
+	ICounter
+
+	mu sync.Mutex
+}
+`)
+	require.Nil(maker.Vet(result, "counter_iface.go"))
+}
+
+func TestComments(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+// Human is a human.
+//
+//go:generate ifacemaker -f human.go -s Human -i IHuman -p main
+type Human struct{}
+
+func (h *Human) Name() string { return "" }
+`
+
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+// See human.go.
+//
+// Do not edit.
+
+package main
+
+// IHuman abstracts Human.
+// It is used in tests.
+//
+// Human is a human.
+type IHuman interface {
+	Name() string
+}
+`
+
+	maker := &Maker{
+		StructName:   "Human",
+		CopyTypeDoc:  true,
+		IfaceComment: "IHuman abstracts Human.\nIt is used in tests.",
+		Comment:      "See human.go.\n\nDo not edit.",
+	}
+	require.Nil(maker.ParseSource([]byte(src), "human.go"))
+	result, err := maker.MakeInterface("main", "IHuman")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+
+	src = `package main
+
+type (
+	// Human is a human.
+	Human struct{}
+	Robot struct{}
+)
+
+func (h *Human) Name() string { return "" }
+`
+	maker = &Maker{StructName: "Human", CopyTypeDoc: true}
+	require.Nil(maker.ParseSource([]byte(src), "human.go"))
+	result, err = maker.MakeInterface("main", "IHuman")
+	require.Nil(err)
+	require.Contains(string(result), "\n// Human is a human.\ntype IHuman interface {\n")
+}
+
+func TestInvocation(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Foo struct {
+}
+
+func (f *Foo) Name() string {
+	return ""
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+//ifacemaker:invocation {"args":["-s","Foo"]}
+// See the README.
+
+package interfaces
+
+type IFoo interface {
+	Name() string
+}
+`
+
+	maker := &Maker{
+		StructName: "Foo",
+		Invocation: `{"args":["-s","Foo"]}`,
+		Comment:    "See the README.",
+	}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+
+	invocation, ok := ReadInvocation(result)
+	require.True(ok)
+	require.Equal(`{"args":["-s","Foo"]}`, invocation)
+
+	_, ok = ReadInvocation([]byte(src))
+	require.False(ok)
+
+	maker.Invocation = "a\nb"
+	_, err = maker.MakeInterface("interfaces", "IFoo")
+	require.EqualError(err, `invalid invocation "a\nb": it must be a single line`)
+}
+
+func TestMethodDocs(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Client struct {
+}
+
+// Get gets the value.
+func (c *Client) Get() string {
+	return ""
+}
+
+func (c *Client) Put(v string) {
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+`
+	expected := `// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+type IClient interface {
+	// Get gets the value.
+	Get() string
+	// Put stores v.
+	//
+	// It overwrites the previous value.
+	Put(v string)
+	// Close releases the connection.
+	Close() error
+}
+`
+
+	maker := &Maker{
+		StructName: "Client",
+		CopyDocs:   true,
+		MethodDocs: map[string]string{
+			"Get":          "Get is ignored, as the method is documented.",
+			"Put":          "Put stores v.\n\nIt overwrites the previous value.\n",
+			"Close":        "Close is ignored, as the receiver is more specific.",
+			"Client.Close": "Close releases the connection.",
+		},
+	}
+	require.Nil(maker.ParseSource([]byte(src), "client.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IClient")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestBuildVariants(t *testing.T) {
+	require := require.New(t)
+
+	files := map[string]string{
+		"x.go":       "package main\n\ntype X struct{}\n\nfunc (x *X) Close() error { return nil }\n",
+		"x_linux.go": "package main\n\nfunc (x *X) Fd() uintptr { return 0 }\n",
+		"x_other.go": "//go:build !linux\n\npackage main\n\nfunc (x *X) Handle() uintptr { return 0 }\n",
+	}
+	parse := func(m *Maker) {
+		for _, name := range []string{"x.go", "x_linux.go", "x_other.go"} {
+			require.Nil(m.ParseSource([]byte(files[name]), name))
+		}
+	}
+
+	maker := &Maker{StructName: "X", GOOS: "linux", GOARCH: "amd64", SkipExcludedFiles: true, BuildConstraint: "linux"}
+	parse(maker)
+	result, err := maker.MakeInterface("main", "IX")
+	require.Nil(err)
+	require.Equal(`//go:build linux
+
+// Code generated by ifacemaker. DO NOT EDIT.
+
+package main
+
+type IX interface {
+	Close() error
+	Fd() uintptr
+}
+`, string(result))
+
+	// Go versions before 1.17 read the // +build lines.
+	maker = &Maker{StructName: "X", BuildConstraint: "linux && (amd64 || arm64)", TargetGoVersion: "go1.16"}
+	parse(maker)
+	result, err = maker.MakeInterface("main", "IX")
+	require.Nil(err)
+	require.True(strings.HasPrefix(string(result), `//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+// Code generated by ifacemaker. DO NOT EDIT.
+`), string(result))
+
+	maker = &Maker{StructName: "X", BuildConstraint: "linux &&"}
+	parse(maker)
+	_, err = maker.MakeInterface("main", "IX")
+	require.NotNil(err)
+	require.Contains(err.Error(), `invalid build constraint "linux &&"`)
+
+	maker = &Maker{StructName: "X", GOOS: "windows", GOARCH: "amd64", SkipExcludedFiles: true}
+	parse(maker)
+	result, err = maker.MakeInterface("main", "IX")
+	require.Nil(err)
+	require.Contains(string(result), "type IX interface {\n\tClose() error\n\tHandle() uintptr\n}\n")
+
+	maker = &Maker{StructName: "X"}
+	parse(maker)
+	result, err = maker.MakeInterface("main", "IX")
+	require.Nil(err)
+	require.Contains(string(result), "type IX interface {\n\tClose() error\n\tFd() uintptr\n\tHandle() uintptr\n}\n")
+}
+
+func TestBuildVariantsArch(t *testing.T) {
+	require := require.New(t)
+
+	files := map[string]string{
+		"x.go":             "package main\n\ntype X struct{}\n\nfunc (x *X) Close() error { return nil }\n",
+		"x_linux.go":       "package main\n\nfunc (x *X) Fd() uintptr { return 0 }\n",
+		"x_linux_amd64.go": "package main\n\nfunc (x *X) AVX() bool { return false }\n",
+		"x_linux_arm64.go": "package main\n\nfunc (x *X) SVE() bool { return false }\n",
+		"x_amd64.go":       "//go:build !windows\n\npackage main\n\nfunc (x *X) Cores() int { return 0 }\n",
+	}
+	parse := func(m *Maker) {
+		for _, name := range []string{"x.go", "x_linux.go", "x_linux_amd64.go", "x_linux_arm64.go", "x_amd64.go"} {
+			require.Nil(m.ParseSource([]byte(files[name]), name))
+		}
+	}
+
+	// With GOOS alone, only the files included for every architecture are,
+	// whatever the architecture of the host.
+	maker := &Maker{StructName: "X", GOOS: "linux", SkipExcludedFiles: true, BuildConstraint: "linux"}
+	parse(maker)
+	result, err := maker.MakeInterface("main", "IX")
+	require.Nil(err)
+	require.Contains(string(result), "type IX interface {\n\tClose() error\n\tFd() uintptr\n}\n")
+	require.Equal(3, maker.Stats().FilesExcluded)
+
+	for arch, method := range map[string]string{"amd64": "\tAVX() bool\n\tCores() int\n", "arm64": "\tSVE() bool\n"} {
+		maker = &Maker{StructName: "X", GOOS: "linux", GOARCH: arch, SkipExcludedFiles: true, BuildConstraint: "linux && " + arch}
+		parse(maker)
+		result, err = maker.MakeInterface("main", "IX")
+		require.Nil(err)
+		require.Contains(string(result), "type IX interface {\n\tClose() error\n\tFd() uintptr\n"+method+"}\n", arch)
+	}
+}
+
+func TestCopyBuildConstraint(t *testing.T) {
+	require := require.New(t)
+
+	src1 := `// Copyright notice.
+
+//go:build linux && !appengine
+
+package main
+
+type Foo struct {
+}
+
+func (f *Foo) Open() error {
+	return nil
+}
+`
+	src2 := `// +build linux,!appengine
+
+package main
+
+func (f *Foo) Close() error {
+	return nil
+}
+`
+	src3 := `package main
+
+func (f *Foo) Name() string {
+	return ""
+}
+`
+	expected := `//go:build linux && !appengine
+
+// Code generated by ifacemaker. DO NOT EDIT.
+
+package interfaces
+
+type IFoo interface {
+	Open() error
+	Close() error
+}
+`
+
+	maker := &Maker{
+		StructName:          "Foo",
+		CopyBuildConstraint: true,
+	}
+	require.Nil(maker.ParseSource([]byte(src1), "foo_unix.go"))
+	require.Nil(maker.ParseSource([]byte(src2), "foo_close.go"))
+
+	result, err := maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+	require.Empty(maker.Warnings())
+
+	maker = &Maker{
+		StructName:          "Foo",
+		CopyBuildConstraint: true,
+	}
+	require.Nil(maker.ParseSource([]byte(src1), "foo_unix.go"))
+	require.Nil(maker.ParseSource([]byte(src3), "foo.go"))
+
+	result, err = maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.True(strings.HasPrefix(string(result), "// Code generated by ifacemaker. DO NOT EDIT."))
+	require.Equal([]string{
+		"the build constraints of the files declaring the methods differ (linux && !appengine; none) and are not copied",
+	}, maker.Warnings())
+
+	// The constraint implied by the file name is copied too.
+	maker = &Maker{
+		StructName:          "Foo",
+		CopyBuildConstraint: true,
+	}
+	require.Nil(maker.ParseSource([]byte(src3), "foo_windows.go"))
+
+	result, err = maker.MakeInterface("interfaces", "IFoo")
+	require.Nil(err)
+	require.True(strings.HasPrefix(string(result), "//go:build windows\n\n"), string(result))
+}
+
+func TestFilterMethods(t *testing.T) {
+	require := require.New(t)
+
+	src := `package store
+
+type Store[K comparable] struct{}
+
+type item struct{}
+
+type key = string
+
+type items = []item
+
+func (s *Store[K]) Get(k key) string           { return "" }
+func (s *Store[K]) Has(k K) bool               { return false }
+func (s *Store[K]) Item(k string) (*item, bool) { return nil, false }
+func (s *Store[K]) Items() items               { return nil }
+func (s *Store[K]) Each(fn func(map[string]item)) {}
+func (s *Store[K]) Reset()                     {}
+func (s *Store[K]) ResetAll()                  {}
+`
+	maker := &Maker{StructName: "Store", ExcludeMethods: regexp.MustCompile("^Reset")}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	result, err := maker.MakeInterface("store", "IStore")
+	require.Nil(err)
+	require.Contains(string(result), "type IStore[K comparable] interface {\n\tGet(k key) string\n\tHas(k K) bool\n}\n")
+	require.Equal(map[SkipReason]int{SkippedFiltered: 2, SkippedUnexportedType: 3}, maker.Stats().SkippedMethods)
+	require.Equal([]string{
+		"method Item is excluded, as it refers to the unexported type item",
+		"method Items is excluded, as it refers to the unexported type item",
+		"method Each is excluded, as it refers to the unexported type item",
+	}, maker.Warnings())
+}
+
+func TestFileConstraint(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []struct {
+		filename, src, expected string
+	}{
+		{"x.go", "package x\n", ""},
+		{"x.go", "//go:build linux && !cgo\n\npackage x\n", "linux && !cgo"},
+		{"x.go", "// +build linux darwin\n// +build !cgo\n\npackage x\n", "(linux || darwin) && !cgo"},
+		{"x.go", "//go:build linux\n// +build darwin\n\npackage x\n", "linux"},
+		{"x_linux.go", "package x\n", "linux"},
+		{"x_arm64.go", "package x\n", "arm64"},
+		{"dir/x_windows_amd64_test.go", "package x\n", "windows && amd64"},
+		{"x_linux.go", "//go:build !cgo\n\npackage x\n", "linux && !cgo"},
+		{"x_linux.go", "//go:build linux\n\npackage x\n", "linux"},
+		{"x_linux.go", "//go:build amd64 || arm64\n\npackage x\n", "linux && (amd64 || arm64)"},
+		// As for the go command, only suffixes are constraints.
+		{"linux.go", "package x\n", ""},
+		{"x_unix.go", "package x\n", ""},
+		{"x_amd64_linux.go", "package x\n", "linux"},
+		{"x_linux.tmpl.go", "package x\n", "linux"},
+	} {
+		require.Equal(test.expected, fileConstraint(test.filename, []byte(test.src)), test.filename)
+	}
+}
+
+func TestTargetGoVersion(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+type Foo struct{}
+
+func (f *Foo) Get(key any) (any, error)        { return nil, nil }
+func (f *Foo) Each(fn func(any) bool, _ ...any) {}
+`
+	maker := &Maker{StructName: "Foo", TargetGoVersion: "go1.17"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	result, err := maker.MakeInterface("main", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), `type IFoo interface {
+	Get(key interface{}) (interface{}, error)
+	Each(fn func(interface{}) bool, _ ...interface{})
+}
+`)
+	require.Nil(maker.Vet(result, "foo_iface.go"))
+
+	maker = &Maker{StructName: "Foo", TargetGoVersion: "go1.18"}
+	require.Nil(maker.ParseSource([]byte(src), "foo.go"))
+	result, err = maker.MakeInterface("main", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "\tGet(key any) (any, error)\n")
+
+	// A declaration named any is not the predeclared type.
+	maker = &Maker{StructName: "Foo", TargetGoVersion: "go1.17"}
+	require.Nil(maker.ParseSource([]byte(src+"\ntype any = int\n"), "foo.go"))
+	result, err = maker.MakeInterface("main", "IFoo")
+	require.Nil(err)
+	require.Contains(string(result), "\tGet(key any) (any, error)\n")
+
+	src = `package main
+
+type Set[T comparable] struct{}
+
+func (s *Set[T]) Has(v T) bool { return false }
+`
+	maker = &Maker{StructName: "Set", GoVersion: "go1.21", TargetGoVersion: "go1.17"}
+	require.Nil(maker.ParseSource([]byte(src), "set.go"))
+	_, err = maker.MakeInterface("main", "ISet")
+	require.NotNil(err)
+	require.Equal("Set has type parameters, which require go1.18, but the target Go version is go1.17", err.Error())
+}
+
+func TestMakeTypes(t *testing.T) {
+	require := require.New(t)
+
+	files := []string{`package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Store stores items.
+type Store struct {
+	db *sql.DB
+}
+
+func (s *Store) Get(id ID) (*Item, error)       { return nil, nil }
+func (s *Store) List(f Filter[Item]) []Item     { return nil }
+func (s *Store) Touch(id ID, at time.Time) error { return nil }
+`, `package store
+
+import "time"
+
+type (
+	// ID identifies an item.
+	ID string
+	// Unused is not referenced by the interface.
+	Unused int
+)
+
+// Item is a stored item.
+type Item struct {
+	ID      ID
+	Created time.Time
+	Tags    []Tag // Tags label the item.
+	Filter  int
+}
+
+type Tag string
+
+type Filter[T any] func(T) bool
+`}
+
+	maker := &Maker{StructName: "Store", CopyTypes: true}
+	for i, src := range files {
+		require.Nil(maker.ParseSource([]byte(src), fmt.Sprintf("store%d.go", i)))
+	}
+	_, err := maker.MakeInterface("api", "IStore")
+	require.Nil(err)
+	names := maker.ReferencedTypes()
+	require.Equal([]string{"ID", "Item", "Tag", "Filter"}, names)
+	result, err := maker.MakeTypes("api", names)
+	require.Nil(err)
+	require.Equal(`// Code generated by ifacemaker. DO NOT EDIT.
+
+package api
+
+import "time"
+
+// ID identifies an item.
+type ID string
+
+// Item is a stored item.
+type Item struct {
+	ID      ID
+	Created time.Time
+	Tags    []Tag // Tags label the item.
+	Filter  int
+}
+
+type Tag string
+
+type Filter[T any] func(T) bool
+`, string(result))
+
+	_, err = maker.MakeTypes("api", []string{"Missing"})
+	require.NotNil(err)
+	require.Equal("type Missing is not declared in the parsed files", err.Error())
+
+	// The constants and variables of the types are copied too.
+	src := `package store
+
+// KeyLen is the length of the keys.
+const KeyLen = 2 * blockSize
+
+const blockSize = 8
+
+type Key [KeyLen]byte
+
+// Mode is the mode of an item.
+type Mode int
+
+// The modes.
+const (
+	ModeA Mode = iota // ModeA is the default.
+	ModeB
+)
+
+const ModeC = Mode(2)
+
+var DefaultMode = ModeA
+
+type Item struct {
+	Key  Key
+	Mode Mode
+	Tags [len(defaultTags)]string
+}
+
+var defaultTags = [...]string{"a", "b"}
+
+const unrelated = 1
+
+type Store struct{}
+
+func (s *Store) Get(key Key) Item { return Item{} }
+`
+	maker = &Maker{StructName: "Store", CopyTypes: true}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	_, err = maker.MakeInterface("api", "IStore")
+	require.Nil(err)
+	names = maker.ReferencedTypes()
+	require.Equal([]string{"KeyLen", "blockSize", "Key", "Mode", "ModeA", "ModeC", "Item", "defaultTags"}, names)
+	result, err = maker.MakeTypes("api", names)
+	require.Nil(err)
+	require.Equal(`// Code generated by ifacemaker. DO NOT EDIT.
+
+package api
+
+// KeyLen is the length of the keys.
+const KeyLen = 2 * blockSize
+
+const blockSize = 8
+
+type Key [KeyLen]byte
+
+// Mode is the mode of an item.
+type Mode int
+
+// The modes.
+const (
+	ModeA Mode = iota // ModeA is the default.
+	ModeB
+)
+
+const ModeC = Mode(2)
+
+type Item struct {
+	Key  Key
+	Mode Mode
+	Tags [len(defaultTags)]string
+}
+
+var defaultTags = [...]string{"a", "b"}
+`, string(result))
+
+	_, err = maker.MakeTypes("api", []string{"Key"})
+	require.EqualError(err, "Key refers to KeyLen, which is not copied")
+
+	src = `package store
+
+type Key [keyLen()]byte
+
+func keyLen() int { return 16 }
+
+type Store struct{}
+
+func (s *Store) Get(key Key) {}
+`
+	maker = &Maker{StructName: "Store", CopyTypes: true}
+	require.Nil(maker.ParseSource([]byte(src), "store.go"))
+	_, err = maker.MakeInterface("api", "IStore")
+	require.Nil(err)
+	_, err = maker.MakeTypes("api", maker.ReferencedTypes())
+	require.EqualError(err, "Key refers to keyLen, which cannot be copied: only types, constants and variables are")
+}
+
+func TestMakeExamples(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import "context"
+
+type Client struct {
+}
+
+// Get returns the value of key, e.g.
+//
+//	v := c.Get("key")
+//	fmt.Println(v)
+//
+// It returns "" if the key is missing.
+func (c *Client) Get(key string) string {
+	return ""
+}
+
+// Put stores v under key, see
+//
+//	the docs of Get (
+func (c *Client) Put(key, v string) {
+}
+
+// Fetch returns the value of key, e.g.
+//
+//	v, err := c.Fetch(ctx, "key")
+func (c *Client) Fetch(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+// Len returns the number of keys, e.g.
+//
+//	n := c.Len()
+func (c *Client) Len() int {
+	return 0
+}
+`
+	expected := `package api
+
+import "fmt"
+
+func ExampleIClient_Get() {
+	var c IClient
+	v := c.Get("key")
+	fmt.Println(v)
+}
+
+func ExampleIClient_Put() {
+	// Call Put of an implementation of IClient.
+}
+
+func ExampleIClient_Fetch() {
+	// Call Fetch of an implementation of IClient, e.g.
+	//
+	//	v, err := c.Fetch(ctx, "key")
+}
+
+func ExampleIClient_Len() {
+	// Call Len of an implementation of IClient, e.g.
+	//
+	//	n := c.Len()
+}
+`
+
+	maker := &Maker{
+		StructName: "Client",
+		CopyDocs:   true,
+	}
+	require.Nil(maker.ParseSource([]byte(src), "client.go"))
+
+	_, err := maker.MakeInterface("api", "IClient")
+	require.Nil(err)
+	result, err := maker.MakeExamples("api", "IClient")
+	require.Nil(err)
+	require.Equal(expected, string(result))
+}
+
+func TestModel(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import (
+	"context"
+	stdtime "time"
+)
+
+// Client talks to the server.
+type Client struct {
+}
+
+// Get returns the value of key.
+func (c *Client) Get(key string) (string, error) {
+	return "", nil
+}
+
+/* Close closes
+the connection. */
+func (c *Client) Close() {
+}
+
+func (Client) Wait(ctx context.Context, d stdtime.Duration) error {
+	return nil
+}
+`
+
+	maker := &Maker{
+		StructName:   "Client",
+		CopyDocs:     true,
+		CopyTypeDoc:  true,
+		IfaceComment: "IClient is generated.",
+	}
+	require.Nil(maker.ParseSource([]byte(src), "client.go"))
+
+	_, err := maker.MakeInterface("api", "IClient")
+	require.Nil(err)
+	require.Equal(Model{
+		Package:   "api",
+		Interface: "IClient",
+		Struct:    "Client",
+		Doc:       "IClient is generated.\n\nClient talks to the server.",
+		Methods: []ModelMethod{
+			{Name: "Get", Signature: "Get(key string) (string, error)", Doc: "Get returns the value of key.",
+				Receiver: "Client", ReceiverName: "c", PointerReceiver: true},
+			{Name: "Close", Signature: "Close()", Doc: "Close closes\nthe connection.",
+				Receiver: "Client", ReceiverName: "c", PointerReceiver: true},
+			{Name: "Wait", Signature: "Wait(ctx context.Context, d stdtime.Duration) error", Receiver: "Client"},
+		},
+		Imports: []ModelImport{{Path: "context"}, {Name: "stdtime", Path: "time"}},
+	}, maker.Model("api", "IClient"))
+}
+
+func TestParseMarkedTypes(t *testing.T) {
+	require := require.New(t)
+
+	src := `package main
+
+import gen "example.com/ifacegen"
+
+// Annotated is annotated.
+//
+//ifacemaker:generate
+type Annotated struct{}
+
+type (
+	Plain    struct{}
+	Embedded struct {
+		gen.Marker
+		name string
+	}
+	Pointer struct{ *gen.Marker }
+	Named   struct{ Marker gen.Marker }
+	//ifacemaker:generate
+	Grouped int
+)
+`
+
+	maker := &Maker{}
+	names, err := maker.ParseMarkedTypes([]byte(src), "types.go", "gen.Marker")
+	require.Nil(err)
+	require.Equal([]string{"Annotated", "Embedded", "Pointer", "Grouped"}, names)
+
+	names, err = maker.ParseMarkedTypes([]byte(src), "types.go", "")
+	require.Nil(err)
+	require.Equal([]string{"Annotated", "Grouped"}, names)
+
+	_, err = maker.ParseMarkedTypes([]byte("package main\n\ntype X struct {"), "bad.go", "")
+	require.NotNil(err)
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mlctrez/ifacemaker/maker"
+)
+
+// commandLine are the arguments of the run, recorded by --record.
+var commandLine []string
+
+// invocation is the record of a run in the generated files.
+type invocation struct {
+	// Dir is the working directory of the run, relative to the directory
+	// of the generated file.
+	Dir  string   `json:"dir"`
+	Args []string `json:"args"`
+}
+
+// recordInvocation returns the record of the run for the generated file
+// output, which is empty for stdout.
+func recordInvocation(output string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	dir := wd
+	if output != "" {
+		if dir, err = filepath.Abs(filepath.Dir(output)); err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel(dir, wd)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(invocation{Dir: filepath.ToSlash(rel), Args: commandLine})
+	return string(b), err
+}
+
+// regen generates the files again with the runs recorded in them. The runs
+// generating several of the files are only done once.
+func regen(files []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		recorded, ok := maker.ReadInvocation(src)
+		if !ok {
+			return fmt.Errorf("%s does not record how it was generated, generate it with --record first", f)
+		}
+		var inv invocation
+		if err := json.Unmarshal([]byte(recorded), &inv); err != nil {
+			return fmt.Errorf("%s: invalid invocation: %v", f, err)
+		}
+		dir := filepath.Join(filepath.Dir(f), filepath.FromSlash(inv.Dir))
+		key := dir + "\x00" + strings.Join(inv.Args, "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		cmd := exec.Command(self, inv.Args...)
+		cmd.Dir = dir
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("regenerating %s in %s: %v", f, dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tempDirs are the directories the remote sources are fetched to.
+var tempDirs []string
+
+// removeTempDirs removes the fetched remote sources.
+func removeTempDirs() {
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	tempDirs = nil
+}
+
+// vcsSource is a reference to a path in a repository, repo@ref//path.
+type vcsSource struct {
+	repo, ref, path string
+}
+
+// parseVCSSource parses the reference s, e.g.
+// github.com/user/repo@v1.2.0//pkg/client. A repository without a scheme
+// that is not a local path or an scp-like address is fetched with https.
+// The ref follows the host, so that the user of https://user@host/repo or
+// git@host:repo is not taken for it. A reference with a repo or ref that git
+// could read as an option, or a ref that is not a valid name, is reported
+// as an error.
+func parseVCSSource(s string) (vcsSource, bool, error) {
+	rest := s
+	hostEnd := ":/"
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+len("://"):]
+		hostEnd = "/"
+	}
+	i := strings.Index(rest, "//")
+	if i < 0 {
+		return vcsSource{}, false, nil
+	}
+	prefix := len(s) - len(rest)
+	repo := s[:prefix+i]
+	host := strings.IndexAny(rest[:i], hostEnd)
+	if host < 0 {
+		return vcsSource{}, false, nil
+	}
+	at := strings.LastIndex(rest[host:i], "@")
+	if at < 0 {
+		return vcsSource{}, false, nil
+	}
+	at += prefix + host
+	if at == len(repo)-1 {
+		return vcsSource{}, false, nil
+	}
+	src := vcsSource{repo: repo[:at], ref: repo[at+1:], path: rest[i+len("//"):]}
+	if strings.HasPrefix(src.repo, "-") {
+		return vcsSource{}, true, fmt.Errorf("invalid repository %q: it must not start with -", src.repo)
+	}
+	if !validRef.MatchString(src.ref) || strings.Contains(src.ref, "..") || strings.Contains(src.ref, "//") ||
+		strings.HasSuffix(src.ref, "/") || strings.HasSuffix(src.ref, ".lock") {
+		return vcsSource{}, true, fmt.Errorf("invalid ref %q: use a branch, tag or commit", src.ref)
+	}
+	if !strings.Contains(src.repo, ":") && !strings.HasPrefix(src.repo, "/") && !strings.HasPrefix(src.repo, ".") {
+		src.repo = "https://" + src.repo
+	}
+	return src, true, nil
+}
+
+// validRef matches the branches, tags and commits accepted as the ref of a
+// repo@ref//path reference, a subset of the names git accepts that cannot be
+// taken for an option.
+var validRef = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+/-]*$`)
+
+// isURL reports whether s is an http or https URL of a source file.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// isRemote reports whether the -f value s is fetched by fetchSources.
+func isRemote(s string) bool {
+	_, ok, _ := parseVCSSource(s)
+	return ok || isURL(s)
+}
+
+// checkSources checks the -f values files without fetching the remote
+// sources, returning the local ones and whether there are remote ones.
+func checkSources(files []string) (local []string, remote bool, err error) {
+	for _, f := range files {
+		if src, ok, perr := parseVCSSource(f); ok {
+			err = perr
+			if err == nil {
+				_, err = checkoutPath("", src.path)
+			}
+			remote = true
+		} else if isURL(f) {
+			var u *url.URL
+			if u, err = url.Parse(f); err == nil && !strings.HasSuffix(u.Path, ".go") {
+				err = fmt.Errorf("not a Go source file, the URL must end with .go")
+			}
+			remote = true
+		} else {
+			local = append(local, f)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("fetching %s: %v", f, err)
+		}
+	}
+	return local, remote, nil
+}
+
+// fetchSources returns files with the remote sources replaced by the paths
+// they are fetched to: a URL is downloaded, and a repo@ref//path reference
+// is fetched with git. The fetched files are removed by removeTempDirs.
+func fetchSources(files []string) ([]string, error) {
+	var result []string
+	for _, f := range files {
+		var local string
+		var err error
+		if src, ok, perr := parseVCSSource(f); ok {
+			err = perr
+			if err == nil {
+				local, err = fetchVCS(src)
+			}
+		} else if isURL(f) {
+			local, err = download(f)
+		} else {
+			local = f
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", f, err)
+		}
+		result = append(result, local)
+	}
+	return result, nil
+}
+
+func download(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if !strings.HasSuffix(name, ".go") {
+		return "", fmt.Errorf("not a Go source file, the URL must end with .go")
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	if err != nil {
+		return "", err
+	}
+	tempDirs = append(tempDirs, dir)
+	local := filepath.Join(dir, name)
+	return local, ioutil.WriteFile(local, b, 0644)
+}
+
+// checkoutPath returns the path p in the checkout dir, refusing paths
+// outside of it.
+func checkoutPath(dir, p string) (string, error) {
+	clean := path.Clean(p)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("the path %s is outside of the repository", p)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func fetchVCS(src vcsSource) (string, error) {
+	if _, err := checkoutPath("", src.path); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	if err != nil {
+		return "", err
+	}
+	tempDirs = append(tempDirs, dir)
+	// Fetching the ref alone works for branches, tags and, on most hosts,
+	// commits, without cloning the history. The arguments follow --, and
+	// the ext transport running commands is disallowed, as the reference
+	// may come from a config file or a generated file replayed by regen.
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"fetch", "-q", "--depth", "1", "--", src.repo, src.ref},
+		{"checkout", "-q", "FETCH_HEAD", "--"},
+	} {
+		cmd := exec.Command("git", append([]string{"-c", "protocol.ext.allow=never"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("git %s: %v\n%s", args[0], err, bytes.TrimSpace(out))
+		}
+	}
+	return checkoutPath(dir, src.path)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/mlctrez/ifacemaker/maker"
+)
+
+// templateFuncs are the helpers of the --template templates, documented in
+// the README.
+var templateFuncs = template.FuncMap{
+	"snake":      snakeCase,
+	"kebab":      kebabCase,
+	"camel":      camelCase,
+	"pascal":     pascalCase,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"receiver":   receiver,
+	"importName": importName,
+	"imports":    importDecl,
+}
+
+// parseTemplate parses the template file of --template, or returns nil if
+// filename is empty.
+func parseTemplate(filename string) (*template.Template, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(filename)).Option("missingkey=error").Funcs(templateFuncs).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// executeTemplate returns the output of tmpl for model.
+func executeTemplate(tmpl *template.Template, model maker.Model) ([]byte, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, model); err != nil {
+		return nil, fmt.Errorf("executing --template: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// words splits s into its words, at underscores, hyphens, spaces and the
+// changes of case, keeping acronyms together, e.g. GetHTTPClient into Get,
+// HTTP and Client.
+func words(s string) []string {
+	var result []string
+	var word []rune
+	runes := []rune(s)
+	for i, r := range runes {
+		if r == '_' || r == '-' || unicode.IsSpace(r) {
+			if len(word) > 0 {
+				result = append(result, string(word))
+			}
+			word = nil
+			continue
+		}
+		if len(word) > 0 && unicode.IsUpper(r) {
+			prev := word[len(word)-1]
+			// An upper case letter starts a word after a lower case letter
+			// or a digit, and ends an acronym followed by a lower case one.
+			if !unicode.IsUpper(prev) || i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+				result = append(result, string(word))
+				word = nil
+			}
+		}
+		word = append(word, r)
+	}
+	if len(word) > 0 {
+		result = append(result, string(word))
+	}
+	return result
+}
+
+// snakeCase returns s in snake case, e.g. get_http_client.
+func snakeCase(s string) string {
+	return strings.ToLower(strings.Join(words(s), "_"))
+}
+
+// kebabCase returns s in kebab case, e.g. get-http-client.
+func kebabCase(s string) string {
+	return strings.ToLower(strings.Join(words(s), "-"))
+}
+
+// pascalCase returns s in Pascal case, e.g. GetHTTPClient. Acronyms are kept
+// as written.
+func pascalCase(s string) string {
+	var b strings.Builder
+	for _, w := range words(s) {
+		r := []rune(w)
+		b.WriteRune(unicode.ToUpper(r[0]))
+		b.WriteString(string(r[1:]))
+	}
+	return b.String()
+}
+
+// camelCase returns s in camel case, e.g. getHTTPClient. A leading acronym
+// is lower cased as a whole, e.g. httpClient.
+func camelCase(s string) string {
+	ws := words(s)
+	if len(ws) == 0 {
+		return ""
+	}
+	return strings.ToLower(ws[0]) + pascalCase(strings.Join(ws[1:], "_"))
+}
+
+// receiver returns the receiver of the method, e.g. c *Client, named after
+// its type if the method does not name it.
+func receiver(method maker.ModelMethod) string {
+	name := method.ReceiverName
+	if name == "" {
+		name = strings.ToLower(string([]rune(method.Receiver)[:1]))
+	}
+	if method.PointerReceiver {
+		return name + " *" + method.Receiver
+	}
+	return name + " " + method.Receiver
+}
+
+// importName returns the name the package of the import path p is referred
+// to with, its last element without a major version suffix, e.g. yaml for
+// go.yaml.in/yaml/v3 and gopkg.in/yaml.v3.
+func importName(p string) string {
+	p = strings.TrimSuffix(p, "/")
+	name := path.Base(p)
+	if isMajorVersion(name) && path.Dir(p) != "." {
+		name = path.Base(path.Dir(p))
+	}
+	if i := strings.Index(name, ".v"); i > 0 && isMajorVersion(name[i+1:]) {
+		name = name[:i]
+	}
+	return strings.Replace(strings.TrimPrefix(name, "go-"), "-", "_", -1)
+}
+
+// isMajorVersion reports whether s is a major version suffix of an import
+// path, e.g. v2.
+func isMajorVersion(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	_, err := strconv.Atoi(s[1:])
+	return err == nil
+}
+
+// importDecl returns the import declaration of imports, a []ModelImport
+// such as the imports of the model, and the extra import paths, sorted and
+// without duplicates, or "" if there are none.
+func importDecl(imports []maker.ModelImport, extra ...string) string {
+	seen := make(map[maker.ModelImport]bool)
+	var all []maker.ModelImport
+	for _, i := range imports {
+		if !seen[i] {
+			seen[i] = true
+			all = append(all, i)
+		}
+	}
+	for _, p := range extra {
+		if i := (maker.ModelImport{Path: p}); !seen[i] {
+			seen[i] = true
+			all = append(all, i)
+		}
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Path != all[j].Path {
+			return all[i].Path < all[j].Path
+		}
+		return all[i].Name < all[j].Name
+	})
+	var b strings.Builder
+	b.WriteString("import (\n")
+	for _, i := range all {
+		b.WriteString("\t")
+		if i.Name != "" {
+			b.WriteString(i.Name + " ")
+		}
+		b.WriteString(strconv.Quote(i.Path) + "\n")
+	}
+	b.WriteString(")")
+	return b.String()
+}
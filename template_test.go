@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mlctrez/ifacemaker/maker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaseHelpers(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []struct {
+		s, snake, kebab, camel, pascal string
+	}{
+		{"GetHTTPClient", "get_http_client", "get-http-client", "getHTTPClient", "GetHTTPClient"},
+		{"HTTPServer", "http_server", "http-server", "httpServer", "HTTPServer"},
+		{"get_by_id", "get_by_id", "get-by-id", "getById", "GetById"},
+		{"user-name", "user_name", "user-name", "userName", "UserName"},
+		{"ID2Name", "id2_name", "id2-name", "id2Name", "ID2Name"},
+		{"Close", "close", "close", "close", "Close"},
+		{"", "", "", "", ""},
+	} {
+		require.Equal(test.snake, snakeCase(test.s), test.s)
+		require.Equal(test.kebab, kebabCase(test.s), test.s)
+		require.Equal(test.camel, camelCase(test.s), test.s)
+		require.Equal(test.pascal, pascalCase(test.s), test.s)
+	}
+}
+
+func TestImportHelpers(t *testing.T) {
+	require := require.New(t)
+
+	for p, name := range map[string]string{
+		"context":                    "context",
+		"go.yaml.in/yaml/v3":         "yaml",
+		"gopkg.in/yaml.v3":           "yaml",
+		"github.com/mattn/go-isatty": "isatty",
+		"github.com/user/multi-word": "multi_word",
+	} {
+		require.Equal(name, importName(p), p)
+	}
+
+	require.Equal("", importDecl(nil))
+	require.Equal("import (\n\t\"context\"\n\tstdtime \"time\"\n)",
+		importDecl([]maker.ModelImport{{Name: "stdtime", Path: "time"}, {Path: "context"}}, "context"))
+}
+
+func TestTemplate(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ifacemaker")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "logging.tmpl")
+	require.Nil(ioutil.WriteFile(filename, []byte(`// Code generated by ifacemaker. DO NOT EDIT.
+
+package {{.Package}}
+
+{{imports .Imports "log"}}
+
+// Logging{{.Interface | trimPrefix "I"}} logs the calls of {{.Interface}}.
+type Logging{{.Interface | trimPrefix "I"}} struct{ Next {{.Interface}} }
+{{range .Methods}}
+// {{.Name}} is logged as {{snake .Name}}, the receiver being ({{receiver .}}).
+{{end}}`), 0644))
+
+	m := &maker.Maker{StructName: "Store"}
+	require.Nil(m.ParseSource([]byte(`package store
+
+import "context"
+
+type Store struct{}
+
+func (s *Store) GetByID(ctx context.Context, id string) string { return "" }
+`), "store.go"))
+	_, err = m.MakeInterface("store", "IStore")
+	require.Nil(err)
+
+	tmpl, err := parseTemplate(filename)
+	require.Nil(err)
+	b, err := executeTemplate(tmpl, m.Model("store", "IStore"))
+	require.Nil(err)
+	require.Equal(`// Code generated by ifacemaker. DO NOT EDIT.
+
+package store
+
+import (
+	"context"
+	"log"
+)
+
+// LoggingStore logs the calls of IStore.
+type LoggingStore struct{ Next IStore }
+
+// GetByID is logged as get_by_id, the receiver being (s *Store).
+`, string(b))
+	require.True(maker.IsGenerated(b))
+
+	require.Nil(ioutil.WriteFile(filename, []byte(`{{.Missing}}`), 0644))
+	tmpl, err = parseTemplate(filename)
+	require.Nil(err)
+	_, err = executeTemplate(tmpl, m.Model("store", "IStore"))
+	require.NotNil(err)
+	require.Contains(err.Error(), "executing --template: ")
+
+	require.Nil(ioutil.WriteFile(filename, []byte(`{{snakes .Name}}`), 0644))
+	_, err = parseTemplate(filename)
+	require.NotNil(err)
+	require.Contains(err.Error(), `invalid --template: `)
+	require.Contains(err.Error(), `function "snakes" not defined`)
+}